@@ -0,0 +1,202 @@
+package restql_mongodb
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/b2wdigital/restQL-golang/v6/pkg/restql"
+	"github.com/pkg/errors"
+)
+
+// ErrCircuitOpen is returned without calling the database while
+// the circuit breaker is open.
+var ErrCircuitOpen = fmt.Errorf("%w: circuit breaker open", restql.ErrDatabaseCommunicationFailed)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (bs breakerState) String() string {
+	switch bs {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// circuitBreaker stops calling the database once the rate of timeouts and
+// unavailability errors crosses the threshold within a window. After the open
+// timeout a few probe calls are let through: the first one to succeed closes the
+// circuit again, while a failure keeps it open for another timeout.
+// A nil *circuitBreaker is valid and lets every call through.
+type circuitBreaker struct {
+	logger           restql.Logger
+	failureRate      float64
+	minimumRequests  int
+	window           time.Duration
+	openTimeout      time.Duration
+	halfOpenRequests int
+	now              func() time.Time
+
+	mu          sync.Mutex
+	state       breakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probes      int
+}
+
+func newCircuitBreaker(log restql.Logger, cfg CircuitBreakerConfig) *circuitBreaker {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	return &circuitBreaker{
+		logger:           log,
+		failureRate:      cfg.FailureRateThreshold,
+		minimumRequests:  cfg.MinimumRequests,
+		window:           time.Duration(cfg.Window),
+		openTimeout:      time.Duration(cfg.OpenTimeout),
+		halfOpenRequests: cfg.HalfOpenRequests,
+		now:              time.Now,
+		windowStart:      time.Now(),
+	}
+}
+
+// allow reports whether a call may go to the database. When it may,
+// the returned function must be called with the outcome of the call.
+func (cb *circuitBreaker) allow() (func(class errorClass), bool) {
+	if cb == nil {
+		return func(errorClass) {}, true
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := cb.now()
+
+	switch cb.state {
+	case breakerOpen:
+		if now.Sub(cb.openedAt) < cb.openTimeout {
+			return nil, false
+		}
+		cb.setState(breakerHalfOpen, now)
+		fallthrough
+	case breakerHalfOpen:
+		if cb.probes >= cb.halfOpenRequests {
+			return nil, false
+		}
+		cb.probes++
+		return cb.probeDone, true
+	}
+
+	if now.Sub(cb.windowStart) >= cb.window {
+		cb.resetWindow(now)
+	}
+
+	return cb.callDone, true
+}
+
+func (cb *circuitBreaker) callDone(class errorClass) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state != breakerClosed || class == errorClassCanceled {
+		return
+	}
+
+	cb.requests++
+	if isBreakerFailure(class) {
+		cb.failures++
+	}
+
+	if cb.requests >= cb.minimumRequests && float64(cb.failures)/float64(cb.requests) >= cb.failureRate {
+		cb.setState(breakerOpen, cb.now())
+	}
+}
+
+func (cb *circuitBreaker) probeDone(class errorClass) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state != breakerHalfOpen {
+		return
+	}
+	cb.probes--
+
+	switch {
+	case class == errorClassCanceled:
+	case isBreakerFailure(class):
+		cb.setState(breakerOpen, cb.now())
+	default:
+		cb.setState(breakerClosed, cb.now())
+	}
+}
+
+func (cb *circuitBreaker) setState(state breakerState, now time.Time) {
+	previous := cb.state
+	cb.state = state
+	cb.probes = 0
+
+	switch state {
+	case breakerOpen:
+		cb.openedAt = now
+		cb.logger.Warn("database circuit breaker state changed", "from", previous.String(), "to", state.String(),
+			"requests", cb.requests, "failures", cb.failures, "openTimeout", cb.openTimeout.String())
+	case breakerClosed:
+		cb.resetWindow(now)
+		cb.logger.Info("database circuit breaker state changed", "from", previous.String(), "to", state.String())
+	default:
+		cb.logger.Info("database circuit breaker state changed", "from", previous.String(), "to", state.String())
+	}
+}
+
+func (cb *circuitBreaker) resetWindow(now time.Time) {
+	cb.windowStart = now
+	cb.requests = 0
+	cb.failures = 0
+}
+
+// isBreakerFailure reports whether the outcome hints at the database being
+// unhealthy. Errors caused by the request itself do not count.
+func isBreakerFailure(class errorClass) bool {
+	return class == errorClassTimeout || class == errorClassUnavailable
+}
+
+// mappingsFallback serves the mappings of a tenant when the database
+// cannot be reached, from the cache, even if expired, while the circuit
+// is open, or else from the snapshot.
+func (md *mongoDatabase) mappingsFallback(log restql.Logger, tenantID string, err error) ([]restql.Mapping, error) {
+	if errors.Is(err, ErrCircuitOpen) {
+		if mappings, found := md.cache.getStaleMappings(tenantID); found {
+			log.Warn("serving mappings from cache while circuit breaker is open", "tenant", tenantID)
+			return parseMappings(log, mappings), nil
+		}
+	}
+
+	return md.mappingsFromSnapshot(log, tenantID, err)
+}
+
+// queryFallback serves a query revision when the database cannot be reached,
+// following the same order as mappingsFallback.
+func (md *mongoDatabase) queryFallback(log restql.Logger, namespace string, name string, revision int, err error) (restql.SavedQueryRevision, error) {
+	if errors.Is(err, ErrCircuitOpen) {
+		if savedQuery, found := md.cache.getStaleQuery(namespace, name, revision); found {
+			log.Warn("serving query from cache while circuit breaker is open", "namespace", namespace, "name", name, "revision", revision)
+			return savedQuery, nil
+		}
+	}
+
+	return md.queryFromSnapshot(log, namespace, name, revision, err)
+}
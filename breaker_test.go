@@ -0,0 +1,144 @@
+package restql_mongodb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/b2wdigital/restQL-golang/v6/pkg/restql"
+)
+
+type noopLogger struct{}
+
+func (noopLogger) Panic(string, ...interface{})             {}
+func (noopLogger) Fatal(string, ...interface{})             {}
+func (noopLogger) Error(string, error, ...interface{})      {}
+func (noopLogger) Warn(string, ...interface{})              {}
+func (noopLogger) Info(string, ...interface{})              {}
+func (noopLogger) Debug(string, ...interface{})             {}
+func (l noopLogger) With(string, interface{}) restql.Logger { return l }
+
+// breakerCall advances the clock, asks the breaker for a call and, when allowed
+// and not held in flight, reports the outcome, checking the state after it.
+type breakerCall struct {
+	advance time.Duration
+	class   errorClass
+	hold    bool
+	allowed bool
+	state   breakerState
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	tests := []struct {
+		name  string
+		calls []breakerCall
+	}{
+		{
+			name: "stays closed below the minimum requests",
+			calls: []breakerCall{
+				{class: errorClassTimeout, allowed: true, state: breakerClosed},
+				{class: errorClassTimeout, allowed: true, state: breakerClosed},
+			},
+		},
+		{
+			name: "opens at the failure rate",
+			calls: []breakerCall{
+				{class: errorClassNone, allowed: true, state: breakerClosed},
+				{class: errorClassTimeout, allowed: true, state: breakerClosed},
+				{class: errorClassUnavailable, allowed: true, state: breakerOpen},
+				{advance: 5 * time.Second, allowed: false, state: breakerOpen},
+			},
+		},
+		{
+			name: "ignores errors caused by the request",
+			calls: []breakerCall{
+				{class: errorClassNotFound, allowed: true, state: breakerClosed},
+				{class: errorClassServer, allowed: true, state: breakerClosed},
+				{class: errorClassCanceled, allowed: true, state: breakerClosed},
+				{class: errorClassTimeout, allowed: true, state: breakerClosed},
+			},
+		},
+		{
+			name: "resets the counts on a new window",
+			calls: []breakerCall{
+				{class: errorClassTimeout, allowed: true, state: breakerClosed},
+				{class: errorClassTimeout, allowed: true, state: breakerClosed},
+				{advance: time.Minute, class: errorClassTimeout, allowed: true, state: breakerClosed},
+				{class: errorClassNone, allowed: true, state: breakerClosed},
+			},
+		},
+		{
+			name: "closes when the half-open probe succeeds",
+			calls: []breakerCall{
+				{class: errorClassTimeout, allowed: true, state: breakerClosed},
+				{class: errorClassTimeout, allowed: true, state: breakerClosed},
+				{class: errorClassTimeout, allowed: true, state: breakerOpen},
+				{advance: 10 * time.Second, class: errorClassNone, allowed: true, state: breakerClosed},
+				{class: errorClassTimeout, allowed: true, state: breakerClosed},
+			},
+		},
+		{
+			name: "reopens when the half-open probe fails",
+			calls: []breakerCall{
+				{class: errorClassTimeout, allowed: true, state: breakerClosed},
+				{class: errorClassTimeout, allowed: true, state: breakerClosed},
+				{class: errorClassTimeout, allowed: true, state: breakerOpen},
+				{advance: 10 * time.Second, class: errorClassTimeout, allowed: true, state: breakerOpen},
+				{advance: 5 * time.Second, allowed: false, state: breakerOpen},
+			},
+		},
+		{
+			name: "limits the half-open probes",
+			calls: []breakerCall{
+				{class: errorClassTimeout, allowed: true, state: breakerClosed},
+				{class: errorClassTimeout, allowed: true, state: breakerClosed},
+				{class: errorClassTimeout, allowed: true, state: breakerOpen},
+				{advance: 10 * time.Second, hold: true, allowed: true, state: breakerHalfOpen},
+				{allowed: false, state: breakerHalfOpen},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+			cb := newCircuitBreaker(noopLogger{}, CircuitBreakerConfig{
+				Enabled:              true,
+				FailureRateThreshold: 0.5,
+				MinimumRequests:      3,
+				Window:               Duration(time.Minute),
+				OpenTimeout:          Duration(10 * time.Second),
+				HalfOpenRequests:     1,
+			})
+			cb.now = func() time.Time { return now }
+			cb.windowStart = now
+
+			for i, call := range tt.calls {
+				now = now.Add(call.advance)
+
+				done, allowed := cb.allow()
+				if allowed != call.allowed {
+					t.Fatalf("call %d: allowed = %t, want %t", i+1, allowed, call.allowed)
+				}
+				if allowed && !call.hold {
+					done(call.class)
+				}
+
+				if cb.state != call.state {
+					t.Fatalf("call %d: state = %s, want %s", i+1, cb.state, call.state)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	cb := newCircuitBreaker(noopLogger{}, CircuitBreakerConfig{Enabled: false})
+
+	for i := 0; i < 10; i++ {
+		done, allowed := cb.allow()
+		if !allowed {
+			t.Fatalf("call %d not allowed by a disabled circuit breaker", i+1)
+		}
+		done(errorClassTimeout)
+	}
+}
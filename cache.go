@@ -0,0 +1,269 @@
+package restql_mongodb
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/b2wdigital/restQL-golang/v6/pkg/restql"
+)
+
+type queryKey struct {
+	Namespace string
+	Name      string
+	Revision  int
+}
+
+type cacheEntry struct {
+	key       interface{}
+	value     interface{}
+	expiresAt time.Time
+}
+
+// lruCache is a size bounded cache with per entry expiration.
+// When full, the least recently used entry is evicted. Expired entries
+// are kept until evicted, so they can still be served by GetStale.
+type lruCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[interface{}]*list.Element
+	order      *list.List
+	now        func() time.Time
+}
+
+func newLruCache(maxEntries int) *lruCache {
+	return &lruCache{
+		maxEntries: maxEntries,
+		entries:    make(map[interface{}]*list.Element),
+		order:      list.New(),
+		now:        time.Now,
+	}
+}
+
+func (c *lruCache) Get(key interface{}) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if c.now().After(entry.expiresAt) {
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	return entry.value, true
+}
+
+// GetStale returns the entry even if it has expired.
+func (c *lruCache) GetStale(key interface{}) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+
+	return element.Value.(*cacheEntry).value, true
+}
+
+func (c *lruCache) Set(key interface{}, value interface{}, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := c.now().Add(ttl)
+	if element, found := c.entries[key]; found {
+		entry := element.Value.(*cacheEntry)
+		entry.value = value
+		entry.expiresAt = expiresAt
+		c.order.MoveToFront(element)
+		return
+	}
+
+	element := c.order.PushFront(&cacheEntry{key: key, value: value, expiresAt: expiresAt})
+	c.entries[key] = element
+
+	for c.maxEntries > 0 && c.order.Len() > c.maxEntries {
+		c.removeElement(c.order.Back())
+	}
+}
+
+func (c *lruCache) Remove(key interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, found := c.entries[key]; found {
+		c.removeElement(element)
+	}
+}
+
+// RemoveFunc drops every entry whose key satisfies the predicate.
+func (c *lruCache) RemoveFunc(match func(key interface{}) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, element := range c.entries {
+		if match(key) {
+			c.removeElement(element)
+		}
+	}
+}
+
+func (c *lruCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[interface{}]*list.Element)
+	c.order.Init()
+}
+
+func (c *lruCache) removeElement(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.order.Remove(element)
+}
+
+// databaseCache holds the read-through cache for mappings and query revisions.
+// A nil *databaseCache is valid and caches nothing.
+type databaseCache struct {
+	mappings       *lruCache
+	queries        *lruCache
+	mappingsTTL    time.Duration
+	queryTTL       time.Duration
+	latestQueryTTL time.Duration
+}
+
+func newDatabaseCache(maxEntries int, mappingsTTL time.Duration, queryTTL time.Duration, latestQueryTTL time.Duration) *databaseCache {
+	if maxEntries <= 0 {
+		return nil
+	}
+
+	return &databaseCache{
+		mappings:       newLruCache(maxEntries),
+		queries:        newLruCache(maxEntries),
+		mappingsTTL:    mappingsTTL,
+		queryTTL:       queryTTL,
+		latestQueryTTL: latestQueryTTL,
+	}
+}
+
+func (dc *databaseCache) getMappings(tenantID string) (map[string]string, bool) {
+	if dc == nil {
+		return nil, false
+	}
+
+	v, found := dc.mappings.Get(tenantID)
+	if !found {
+		return nil, false
+	}
+
+	return v.(map[string]string), true
+}
+
+func (dc *databaseCache) getStaleMappings(tenantID string) (map[string]string, bool) {
+	if dc == nil {
+		return nil, false
+	}
+
+	v, found := dc.mappings.GetStale(tenantID)
+	if !found {
+		return nil, false
+	}
+
+	return v.(map[string]string), true
+}
+
+func (dc *databaseCache) setMappings(tenantID string, mappings map[string]string) {
+	if dc == nil {
+		return
+	}
+
+	dc.mappings.Set(tenantID, mappings, dc.mappingsTTL)
+}
+
+func (dc *databaseCache) invalidateMappings(tenantID string) {
+	if dc == nil {
+		return
+	}
+
+	dc.mappings.Remove(tenantID)
+}
+
+func (dc *databaseCache) getQuery(namespace string, name string, revision int) (restql.SavedQueryRevision, bool) {
+	if dc == nil {
+		return restql.SavedQueryRevision{}, false
+	}
+
+	v, found := dc.queries.Get(queryKey{Namespace: namespace, Name: name, Revision: revision})
+	if !found {
+		return restql.SavedQueryRevision{}, false
+	}
+
+	return v.(restql.SavedQueryRevision), true
+}
+
+func (dc *databaseCache) getStaleQuery(namespace string, name string, revision int) (restql.SavedQueryRevision, bool) {
+	if dc == nil {
+		return restql.SavedQueryRevision{}, false
+	}
+
+	v, found := dc.queries.GetStale(queryKey{Namespace: namespace, Name: name, Revision: revision})
+	if !found {
+		return restql.SavedQueryRevision{}, false
+	}
+
+	return v.(restql.SavedQueryRevision), true
+}
+
+func (dc *databaseCache) setQuery(namespace string, name string, revision int, r restql.SavedQueryRevision) {
+	if dc == nil {
+		return
+	}
+
+	dc.queries.Set(queryKey{Namespace: namespace, Name: name, Revision: revision}, r, dc.queryTTL)
+}
+
+// setLatestQuery caches a lookup of the latest revision, which changes whenever
+// a revision is created or archived, so it is kept only for the latest query TTL.
+func (dc *databaseCache) setLatestQuery(namespace string, name string, revision int, r restql.SavedQueryRevision) {
+	if dc == nil {
+		return
+	}
+
+	dc.queries.Set(queryKey{Namespace: namespace, Name: name, Revision: revision}, r, dc.latestQueryTTL)
+}
+
+func (dc *databaseCache) invalidateQuery(namespace string, name string) {
+	if dc == nil {
+		return
+	}
+
+	dc.queries.RemoveFunc(func(key interface{}) bool {
+		k := key.(queryKey)
+		return k.Namespace == namespace && k.Name == name
+	})
+}
+
+func (dc *databaseCache) purgeMappings() {
+	if dc == nil {
+		return
+	}
+
+	dc.mappings.Purge()
+}
+
+func (dc *databaseCache) purgeQueries() {
+	if dc == nil {
+		return
+	}
+
+	dc.queries.Purge()
+}
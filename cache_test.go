@@ -0,0 +1,166 @@
+package restql_mongodb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/b2wdigital/restQL-golang/v6/pkg/restql"
+)
+
+func TestLruCache(t *testing.T) {
+	type step struct {
+		advance time.Duration
+		set     string
+		ttl     time.Duration
+		get     string
+	}
+
+	tests := []struct {
+		name    string
+		steps   []step
+		found   []string
+		missing []string
+		stale   []string
+	}{
+		{
+			name: "evicts the least recently used entry",
+			steps: []step{
+				{set: "a", ttl: time.Hour},
+				{set: "b", ttl: time.Hour},
+				{set: "c", ttl: time.Hour},
+			},
+			found:   []string{"b", "c"},
+			missing: []string{"a"},
+		},
+		{
+			name: "reading an entry keeps it from eviction",
+			steps: []step{
+				{set: "a", ttl: time.Hour},
+				{set: "b", ttl: time.Hour},
+				{get: "a"},
+				{set: "c", ttl: time.Hour},
+			},
+			found:   []string{"a", "c"},
+			missing: []string{"b"},
+		},
+		{
+			name: "setting an existing entry does not evict",
+			steps: []step{
+				{set: "a", ttl: time.Hour},
+				{set: "b", ttl: time.Hour},
+				{set: "a", ttl: time.Hour},
+			},
+			found: []string{"a", "b"},
+		},
+		{
+			name: "expired entries are only served stale",
+			steps: []step{
+				{set: "a", ttl: time.Minute},
+				{set: "b", ttl: time.Hour},
+				{advance: 2 * time.Minute},
+			},
+			found:   []string{"b"},
+			missing: []string{"a"},
+			stale:   []string{"a", "b"},
+		},
+		{
+			name: "setting an entry renews its expiration",
+			steps: []step{
+				{set: "a", ttl: time.Minute},
+				{advance: 50 * time.Second},
+				{set: "a", ttl: time.Minute},
+				{advance: 50 * time.Second},
+			},
+			found: []string{"a"},
+		},
+		{
+			name: "entries without a ttl are not cached",
+			steps: []step{
+				{set: "a", ttl: 0},
+			},
+			missing: []string{"a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+			cache := newLruCache(2)
+			cache.now = func() time.Time { return now }
+
+			for _, s := range tt.steps {
+				now = now.Add(s.advance)
+				if s.set != "" {
+					cache.Set(s.set, s.set, s.ttl)
+				}
+				if s.get != "" {
+					cache.Get(s.get)
+				}
+			}
+
+			for _, key := range tt.found {
+				if v, found := cache.Get(key); !found || v != key {
+					t.Errorf("Get(%q) = %v, %t, want %q, true", key, v, found, key)
+				}
+			}
+			for _, key := range tt.missing {
+				if v, found := cache.Get(key); found {
+					t.Errorf("Get(%q) = %v, true, want it missing", key, v)
+				}
+			}
+			for _, key := range tt.stale {
+				if v, found := cache.GetStale(key); !found || v != key {
+					t.Errorf("GetStale(%q) = %v, %t, want %q, true", key, v, found, key)
+				}
+			}
+		})
+	}
+}
+
+func TestDatabaseCacheInvalidateQuery(t *testing.T) {
+	dc := newDatabaseCache(10, time.Minute, time.Hour, time.Minute)
+	dc.setQuery("hero", "fetch", 1, restql.SavedQueryRevision{Name: "fetch", Revision: 1})
+	dc.setQuery("hero", "fetch", 2, restql.SavedQueryRevision{Name: "fetch", Revision: 2})
+	dc.setQuery("hero", "list", 1, restql.SavedQueryRevision{Name: "list", Revision: 1})
+
+	dc.invalidateQuery("hero", "fetch")
+
+	if _, found := dc.getQuery("hero", "fetch", 1); found {
+		t.Error("revision 1 of hero/fetch is still cached")
+	}
+	if _, found := dc.getQuery("hero", "fetch", 2); found {
+		t.Error("revision 2 of hero/fetch is still cached")
+	}
+	if _, found := dc.getQuery("hero", "list", 1); !found {
+		t.Error("revision 1 of hero/list was invalidated")
+	}
+}
+
+func TestDatabaseCacheLatestQuery(t *testing.T) {
+	now := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+	dc := newDatabaseCache(10, time.Hour, 24*time.Hour, time.Minute)
+	dc.queries.now = func() time.Time { return now }
+
+	dc.setQuery("hero", "fetch", 1, restql.SavedQueryRevision{Name: "fetch", Revision: 1})
+	dc.setLatestQuery("hero", "fetch", 0, restql.SavedQueryRevision{Name: "fetch", Revision: 1})
+
+	if _, found := dc.getQuery("hero", "fetch", 0); !found {
+		t.Error("latest revision of hero/fetch is not cached")
+	}
+
+	now = now.Add(2 * time.Minute)
+
+	if _, found := dc.getQuery("hero", "fetch", 0); found {
+		t.Error("latest revision of hero/fetch is still cached after the latest query ttl")
+	}
+	if _, found := dc.getQuery("hero", "fetch", 1); !found {
+		t.Error("revision 1 of hero/fetch expired with the latest query ttl")
+	}
+
+	dc.setLatestQuery("hero", "fetch", 0, restql.SavedQueryRevision{Name: "fetch", Revision: 1})
+	dc.invalidateQuery("hero", "fetch")
+
+	if _, found := dc.getQuery("hero", "fetch", 0); found {
+		t.Error("latest revision of hero/fetch is still cached after the invalidation")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/b2wdigital/restQL-golang/v6/pkg/restql"
+)
+
+// consoleLogger writes the plugin logs to stderr, keeping
+// stdout free for the output of the commands.
+type consoleLogger struct {
+	debug  bool
+	fields []interface{}
+}
+
+func (cl consoleLogger) Panic(msg string, fields ...interface{}) {
+	cl.print("PANIC", msg, fields)
+	panic(msg)
+}
+
+func (cl consoleLogger) Fatal(msg string, fields ...interface{}) {
+	cl.print("FATAL", msg, fields)
+	os.Exit(1)
+}
+
+func (cl consoleLogger) Error(msg string, err error, fields ...interface{}) {
+	cl.print("ERROR", msg, append(fields, "error", err))
+}
+
+func (cl consoleLogger) Warn(msg string, fields ...interface{}) {
+	cl.print("WARN", msg, fields)
+}
+
+func (cl consoleLogger) Info(msg string, fields ...interface{}) {
+	cl.print("INFO", msg, fields)
+}
+
+func (cl consoleLogger) Debug(msg string, fields ...interface{}) {
+	if cl.debug {
+		cl.print("DEBUG", msg, fields)
+	}
+}
+
+func (cl consoleLogger) With(key string, value interface{}) restql.Logger {
+	fields := append(append([]interface{}{}, cl.fields...), key, value)
+	return consoleLogger{debug: cl.debug, fields: fields}
+}
+
+func (cl consoleLogger) print(level string, msg string, fields []interface{}) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] %s", level, msg)
+
+	all := append(append([]interface{}{}, cl.fields...), fields...)
+	for i := 0; i+1 < len(all); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", all[i], all[i+1])
+	}
+
+	fmt.Fprintln(os.Stderr, b.String())
+}
@@ -0,0 +1,160 @@
+// Command restql-mongodb runs maintenance tasks on the database used by
+// the restQL MongoDB plugin. It reads the same configuration as the plugin.
+//
+// Usage:
+//
+//	restql-mongodb [-debug] <command> [flags]
+//
+// Commands:
+//
+//	migrate-revisions   move embedded revisions to the revisions collection
+//	merge-duplicates    merge queries saved more than once under the same name
+//	check-consistency   report and repair inconsistent queries and tenants
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/b2wdigital/restQL-golang/v6/pkg/restql"
+	mongodb "github.com/b2wdigital/restQL-plugin-mongodb"
+)
+
+type command struct {
+	description string
+	run         func(ctx context.Context, plugin mongodb.Plugin, args []string) error
+}
+
+var commands = map[string]command{
+	"migrate-revisions": {
+		description: "move embedded revisions to the revisions collection",
+		run:         migrateRevisions,
+	},
+	"merge-duplicates": {
+		description: "merge queries saved more than once under the same name",
+		run:         mergeDuplicates,
+	},
+	"check-consistency": {
+		description: "report and repair inconsistent queries and tenants",
+		run:         checkConsistency,
+	},
+}
+
+func main() {
+	debug := flag.Bool("debug", false, "print debug logs")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, found := commands[flag.Arg(0)]
+	if !found {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	err := run(consoleLogger{debug: *debug}, cmd, flag.Args()[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run(log restql.Logger, cmd command, args []string) error {
+	cfg, err := mongodb.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	// maintenance commands must see the database itself, never stale data
+	cfg.LazyConnect = false
+	cfg.Cache.MaxEntries = 0
+	cfg.Snapshot.Path = ""
+	// nor refuse to start over the duplicates they are meant to fix
+	cfg.Indexes.Strict = false
+
+	plugin, err := mongodb.NewMongoDatabaseWithConfig(log, cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx := restql.WithLogger(context.Background(), log)
+	defer plugin.Close(context.Background())
+
+	return cmd.run(ctx, plugin, args)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: restql-mongodb [-debug] <command> [flags]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for name, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-20s %s\n", name, cmd.description)
+	}
+}
+
+func migrateRevisions(ctx context.Context, plugin mongodb.Plugin, args []string) error {
+	flags := flag.NewFlagSet("migrate-revisions", flag.ExitOnError)
+	flags.Parse(args)
+
+	report, err := plugin.MigrateRevisions(ctx)
+	if err != nil {
+		return err
+	}
+
+	return printJSON(report)
+}
+
+func mergeDuplicates(ctx context.Context, plugin mongodb.Plugin, args []string) error {
+	flags := flag.NewFlagSet("merge-duplicates", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only report the duplicated queries")
+	backup := flags.String("backup", "", "file the affected documents are saved to before merging, required unless -dry-run")
+	flags.Parse(args)
+
+	opts := mongodb.MergeOptions{DryRun: *dryRun}
+	if !*dryRun {
+		if *backup == "" {
+			return fmt.Errorf("-backup is required unless -dry-run is set")
+		}
+
+		file, err := os.OpenFile(*backup, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		opts.Backup = file
+	}
+
+	report, err := plugin.MergeDuplicateQueries(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	return printJSON(report)
+}
+
+func checkConsistency(ctx context.Context, plugin mongodb.Plugin, args []string) error {
+	flags := flag.NewFlagSet("check-consistency", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "fix the problems that can be fixed safely")
+	flags.Parse(args)
+
+	report, err := plugin.CheckConsistency(ctx, *repair)
+	if err != nil {
+		return err
+	}
+
+	return printJSON(report)
+}
+
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
@@ -0,0 +1,723 @@
+package restql_mongodb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"gopkg.in/yaml.v3"
+)
+
+// Default configuration values
+const (
+	DefaultConnectionTimeout                = 10 * time.Second
+	DefaultMappingsReadTimeout              = time.Second
+	DefaultQueryReadTimeout                 = time.Second
+	DefaultWriteTimeout                     = 5 * time.Second
+	DefaultCacheMappingsTTL                 = time.Minute
+	DefaultCacheQueryTTL                    = 24 * time.Hour
+	DefaultCacheLatestQueryTTL              = time.Minute
+	DefaultSnapshotFlushInterval            = 30 * time.Second
+	DefaultCredentialsReloadInterval        = 30 * time.Second
+	DefaultShutdownTimeout                  = 10 * time.Second
+	DefaultRetryMaxAttempts                 = 3
+	DefaultRetryBaseBackoff                 = 50 * time.Millisecond
+	DefaultRetryMaxBackoff                  = 500 * time.Millisecond
+	DefaultRetryJitter                      = 0.2
+	DefaultBreakerFailureRate               = 0.5
+	DefaultBreakerMinimumRequests           = 20
+	DefaultBreakerWindow                    = 10 * time.Second
+	DefaultBreakerOpenTimeout               = 30 * time.Second
+	DefaultBreakerHalfOpenRequests          = 1
+	DefaultMaxPoolSize               uint64 = 100
+)
+
+const x509AuthMechanism = "MONGODB-X509"
+
+// Revision deduplication modes, comparing a new revision text with the latest one.
+const (
+	DeduplicateExact      = "exact"
+	DeduplicateWhitespace = "whitespace"
+)
+
+var supportedCompressors = map[string]struct{}{"snappy": {}, "zlib": {}, "zstd": {}}
+
+// Duration is a time.Duration that can be decoded from
+// a Golang Duration string in JSON and YAML files.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return errors.Errorf("invalid duration %s: expected a string", b)
+	}
+
+	return d.parse(s)
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	return d.parse(value.Value)
+}
+
+func (d *Duration) parse(s string) error {
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+// Config holds every setting of the plugin.
+// Zero values are replaced by the defaults when loaded through LoadConfig.
+type Config struct {
+	ConnectionString string   `json:"connectionString" yaml:"connectionString"`
+	DatabaseName     string   `json:"databaseName" yaml:"databaseName"`
+	AppName          string   `json:"appName" yaml:"appName"`
+	MinPoolSize      uint64   `json:"minPoolSize" yaml:"minPoolSize"`
+	MaxPoolSize      uint64   `json:"maxPoolSize" yaml:"maxPoolSize"`
+	ReadPreference   string   `json:"readPreference" yaml:"readPreference"`
+	WriteConcern     string   `json:"writeConcern" yaml:"writeConcern"`
+	Compressors      []string `json:"compressors" yaml:"compressors"`
+	LazyConnect      bool     `json:"lazyConnect" yaml:"lazyConnect"`
+	AuthMechanism    string   `json:"authMechanism" yaml:"authMechanism"`
+	HandleSignals    bool     `json:"handleSignals" yaml:"handleSignals"`
+	LatestRevision   int      `json:"latestRevision" yaml:"latestRevision"`
+	// RevisionsCollection stores each revision as its own document in the
+	// named collection, instead of embedded in the query document.
+	RevisionsCollection string `json:"revisionsCollection" yaml:"revisionsCollection"`
+	// RevisionDeduplication skips creating a revision with the same text as the
+	// latest one, compared exactly or ignoring whitespace. Disabled when empty.
+	RevisionDeduplication string `json:"revisionDeduplication" yaml:"revisionDeduplication"`
+	// AuthorHeader names the request header recorded as the author of new
+	// revisions when the context carries no author. Disabled when empty.
+	AuthorHeader string `json:"authorHeader" yaml:"authorHeader"`
+
+	ConnectionTimeout   Duration `json:"connectionTimeout" yaml:"connectionTimeout"`
+	MappingsReadTimeout Duration `json:"mappingsReadTimeout" yaml:"mappingsReadTimeout"`
+	QueryReadTimeout    Duration `json:"queryReadTimeout" yaml:"queryReadTimeout"`
+	WriteTimeout        Duration `json:"writeTimeout" yaml:"writeTimeout"`
+	ShutdownTimeout     Duration `json:"shutdownTimeout" yaml:"shutdownTimeout"`
+
+	Credentials    CredentialsConfig    `json:"credentials" yaml:"credentials"`
+	TLS            TLSConfig            `json:"tls" yaml:"tls"`
+	Cache          CacheConfig          `json:"cache" yaml:"cache"`
+	Snapshot       SnapshotConfig       `json:"snapshot" yaml:"snapshot"`
+	Retry          RetryConfig          `json:"retry" yaml:"retry"`
+	CircuitBreaker CircuitBreakerConfig `json:"circuitBreaker" yaml:"circuitBreaker"`
+	Indexes        IndexesConfig        `json:"indexes" yaml:"indexes"`
+
+	// resolved from the credential files
+	username string
+	password string
+	caPEM    string
+}
+
+// TLSConfig holds the certificate files used to secure the connection.
+// The CA bundle is reloaded together with the credential files, while the
+// client certificate is reloaded on the next handshake after it changes.
+type TLSConfig struct {
+	Enabled         bool   `json:"enabled" yaml:"enabled"`
+	CAFile          string `json:"caFile" yaml:"caFile"`
+	CertificateFile string `json:"certificateFile" yaml:"certificateFile"`
+	KeyFile         string `json:"keyFile" yaml:"keyFile"`
+}
+
+func (tc TLSConfig) enabled() bool {
+	return tc.Enabled || tc.CAFile != "" || tc.CertificateFile != ""
+}
+
+// CredentialsConfig holds the files from which the connection string
+// and credentials are read. The files are watched and the client is
+// rebuilt when their content changes.
+type CredentialsConfig struct {
+	ConnectionStringFile string   `json:"connectionStringFile" yaml:"connectionStringFile"`
+	UsernameFile         string   `json:"usernameFile" yaml:"usernameFile"`
+	PasswordFile         string   `json:"passwordFile" yaml:"passwordFile"`
+	ReloadInterval       Duration `json:"reloadInterval" yaml:"reloadInterval"`
+}
+
+func (cc CredentialsConfig) enabled() bool {
+	return cc.ConnectionStringFile != "" || cc.UsernameFile != "" || cc.PasswordFile != ""
+}
+
+// watchesFiles reports whether any file resolved by
+// resolveCredentials must be watched for changes.
+func (c Config) watchesFiles() bool {
+	return c.Credentials.enabled() || c.TLS.CAFile != ""
+}
+
+// CacheConfig holds the read-through cache settings.
+// The cache is disabled when MaxEntries is zero.
+type CacheConfig struct {
+	MaxEntries     int      `json:"maxEntries" yaml:"maxEntries"`
+	MappingsTTL    Duration `json:"mappingsTTL" yaml:"mappingsTTL"`
+	QueryTTL       Duration `json:"queryTTL" yaml:"queryTTL"`
+	LatestQueryTTL Duration `json:"latestQueryTTL" yaml:"latestQueryTTL"`
+	WatchEnabled   bool     `json:"watchEnabled" yaml:"watchEnabled"`
+}
+
+// SnapshotConfig holds the local snapshot settings.
+// The snapshot is disabled when Path is empty.
+type SnapshotConfig struct {
+	Path          string   `json:"path" yaml:"path"`
+	FlushInterval Duration `json:"flushInterval" yaml:"flushInterval"`
+}
+
+// RetryConfig holds the retry policy of read operations. Only errors the
+// driver labels as retryable are retried, and never past the read timeout.
+// Jitter is the fraction by which each backoff is randomly spread.
+type RetryConfig struct {
+	MaxAttempts int      `json:"maxAttempts" yaml:"maxAttempts"`
+	BaseBackoff Duration `json:"baseBackoff" yaml:"baseBackoff"`
+	MaxBackoff  Duration `json:"maxBackoff" yaml:"maxBackoff"`
+	Jitter      float64  `json:"jitter" yaml:"jitter"`
+}
+
+// CircuitBreakerConfig holds the circuit breaker settings. The circuit opens
+// when, within a window with at least MinimumRequests calls, the rate of timeouts
+// and unavailability errors reaches FailureRateThreshold. After OpenTimeout up to
+// HalfOpenRequests probe calls are let through to check if the database recovered.
+type CircuitBreakerConfig struct {
+	Enabled              bool     `json:"enabled" yaml:"enabled"`
+	FailureRateThreshold float64  `json:"failureRateThreshold" yaml:"failureRateThreshold"`
+	MinimumRequests      int      `json:"minimumRequests" yaml:"minimumRequests"`
+	Window               Duration `json:"window" yaml:"window"`
+	OpenTimeout          Duration `json:"openTimeout" yaml:"openTimeout"`
+	HalfOpenRequests     int      `json:"halfOpenRequests" yaml:"halfOpenRequests"`
+}
+
+// IndexesConfig holds the index management settings. The required indexes
+// are always checked on startup, missing ones are created when Ensure is set,
+// and the plugin refuses to start without them when Strict is set.
+type IndexesConfig struct {
+	Ensure bool `json:"ensure" yaml:"ensure"`
+	Strict bool `json:"strict" yaml:"strict"`
+}
+
+// DefaultConfig returns the configuration used when no setting is provided.
+func DefaultConfig() Config {
+	return Config{
+		MaxPoolSize:         DefaultMaxPoolSize,
+		ConnectionTimeout:   Duration(DefaultConnectionTimeout),
+		MappingsReadTimeout: Duration(DefaultMappingsReadTimeout),
+		QueryReadTimeout:    Duration(DefaultQueryReadTimeout),
+		WriteTimeout:        Duration(DefaultWriteTimeout),
+		ShutdownTimeout:     Duration(DefaultShutdownTimeout),
+		Credentials: CredentialsConfig{
+			ReloadInterval: Duration(DefaultCredentialsReloadInterval),
+		},
+		Cache: CacheConfig{
+			MappingsTTL:    Duration(DefaultCacheMappingsTTL),
+			QueryTTL:       Duration(DefaultCacheQueryTTL),
+			LatestQueryTTL: Duration(DefaultCacheLatestQueryTTL),
+			WatchEnabled:   true,
+		},
+		Snapshot: SnapshotConfig{
+			FlushInterval: Duration(DefaultSnapshotFlushInterval),
+		},
+		Retry: RetryConfig{
+			MaxAttempts: DefaultRetryMaxAttempts,
+			BaseBackoff: Duration(DefaultRetryBaseBackoff),
+			MaxBackoff:  Duration(DefaultRetryMaxBackoff),
+			Jitter:      DefaultRetryJitter,
+		},
+		CircuitBreaker: CircuitBreakerConfig{
+			FailureRateThreshold: DefaultBreakerFailureRate,
+			MinimumRequests:      DefaultBreakerMinimumRequests,
+			Window:               Duration(DefaultBreakerWindow),
+			OpenTimeout:          Duration(DefaultBreakerOpenTimeout),
+			HalfOpenRequests:     DefaultBreakerHalfOpenRequests,
+		},
+	}
+}
+
+// ConfigError lists every problem found while loading or validating the configuration.
+type ConfigError struct {
+	Problems []string
+}
+
+func (ce *ConfigError) Error() string {
+	return fmt.Sprintf("invalid mongo plugin configuration: %s", strings.Join(ce.Problems, "; "))
+}
+
+// LoadConfig builds the configuration from the defaults, the optional file
+// named by RESTQL_DATABASE_CONFIG_FILE and the environment variables, in this
+// order of precedence. Every invalid value is reported at once in a *ConfigError.
+func LoadConfig() (Config, error) {
+	cfg := DefaultConfig()
+
+	if path := os.Getenv("RESTQL_DATABASE_CONFIG_FILE"); path != "" {
+		err := loadConfigFile(path, &cfg)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+
+	env := envReader{}
+	env.string("RESTQL_DATABASE_CONNECTION_STRING", &cfg.ConnectionString)
+	env.string("RESTQL_DATABASE_CONNECTION_STRING_FILE", &cfg.Credentials.ConnectionStringFile)
+	env.string("RESTQL_DATABASE_USERNAME_FILE", &cfg.Credentials.UsernameFile)
+	env.string("RESTQL_DATABASE_PASSWORD_FILE", &cfg.Credentials.PasswordFile)
+	env.duration("RESTQL_DATABASE_CREDENTIALS_RELOAD_INTERVAL", &cfg.Credentials.ReloadInterval)
+	env.string("RESTQL_DATABASE_NAME", &cfg.DatabaseName)
+	env.string("RESTQL_DATABASE_APP_NAME", &cfg.AppName)
+	env.uint("RESTQL_DATABASE_MIN_POOL_SIZE", &cfg.MinPoolSize)
+	env.uint("RESTQL_DATABASE_MAX_POOL_SIZE", &cfg.MaxPoolSize)
+	env.string("RESTQL_DATABASE_READ_PREFERENCE", &cfg.ReadPreference)
+	env.string("RESTQL_DATABASE_WRITE_CONCERN", &cfg.WriteConcern)
+	env.list("RESTQL_DATABASE_COMPRESSORS", &cfg.Compressors)
+	env.bool("RESTQL_DATABASE_LAZY_CONNECT", &cfg.LazyConnect)
+	env.string("RESTQL_DATABASE_AUTH_MECHANISM", &cfg.AuthMechanism)
+	env.bool("RESTQL_DATABASE_HANDLE_SIGNALS", &cfg.HandleSignals)
+	env.int("RESTQL_DATABASE_LATEST_REVISION", &cfg.LatestRevision)
+	env.string("RESTQL_DATABASE_REVISIONS_COLLECTION", &cfg.RevisionsCollection)
+	env.string("RESTQL_DATABASE_REVISION_DEDUPLICATION", &cfg.RevisionDeduplication)
+	env.string("RESTQL_DATABASE_AUTHOR_HEADER", &cfg.AuthorHeader)
+	env.duration("RESTQL_DATABASE_SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout)
+	env.bool("RESTQL_DATABASE_TLS_ENABLED", &cfg.TLS.Enabled)
+	env.string("RESTQL_DATABASE_TLS_CA_FILE", &cfg.TLS.CAFile)
+	env.string("RESTQL_DATABASE_TLS_CERTIFICATE_FILE", &cfg.TLS.CertificateFile)
+	env.string("RESTQL_DATABASE_TLS_KEY_FILE", &cfg.TLS.KeyFile)
+	env.duration("RESTQL_DATABASE_CONNECTION_TIMEOUT", &cfg.ConnectionTimeout)
+	env.duration("RESTQL_DATABASE_MAPPINGS_READ_TIMEOUT", &cfg.MappingsReadTimeout)
+	env.duration("RESTQL_DATABASE_QUERY_READ_TIMEOUT", &cfg.QueryReadTimeout)
+	env.duration("RESTQL_DATABASE_WRITE_TIMEOUT", &cfg.WriteTimeout)
+	env.int("RESTQL_DATABASE_CACHE_MAX_ENTRIES", &cfg.Cache.MaxEntries)
+	env.duration("RESTQL_DATABASE_CACHE_MAPPINGS_TTL", &cfg.Cache.MappingsTTL)
+	env.duration("RESTQL_DATABASE_CACHE_QUERY_TTL", &cfg.Cache.QueryTTL)
+	env.duration("RESTQL_DATABASE_CACHE_LATEST_QUERY_TTL", &cfg.Cache.LatestQueryTTL)
+	env.bool("RESTQL_DATABASE_CACHE_WATCH_ENABLED", &cfg.Cache.WatchEnabled)
+	env.string("RESTQL_DATABASE_SNAPSHOT_PATH", &cfg.Snapshot.Path)
+	env.duration("RESTQL_DATABASE_SNAPSHOT_FLUSH_INTERVAL", &cfg.Snapshot.FlushInterval)
+	env.int("RESTQL_DATABASE_RETRY_MAX_ATTEMPTS", &cfg.Retry.MaxAttempts)
+	env.duration("RESTQL_DATABASE_RETRY_BASE_BACKOFF", &cfg.Retry.BaseBackoff)
+	env.duration("RESTQL_DATABASE_RETRY_MAX_BACKOFF", &cfg.Retry.MaxBackoff)
+	env.float("RESTQL_DATABASE_RETRY_JITTER", &cfg.Retry.Jitter)
+	env.bool("RESTQL_DATABASE_INDEXES_ENSURE", &cfg.Indexes.Ensure)
+	env.bool("RESTQL_DATABASE_INDEXES_STRICT", &cfg.Indexes.Strict)
+	env.bool("RESTQL_DATABASE_CIRCUIT_BREAKER_ENABLED", &cfg.CircuitBreaker.Enabled)
+	env.float("RESTQL_DATABASE_CIRCUIT_BREAKER_FAILURE_RATE", &cfg.CircuitBreaker.FailureRateThreshold)
+	env.int("RESTQL_DATABASE_CIRCUIT_BREAKER_MINIMUM_REQUESTS", &cfg.CircuitBreaker.MinimumRequests)
+	env.duration("RESTQL_DATABASE_CIRCUIT_BREAKER_WINDOW", &cfg.CircuitBreaker.Window)
+	env.duration("RESTQL_DATABASE_CIRCUIT_BREAKER_OPEN_TIMEOUT", &cfg.CircuitBreaker.OpenTimeout)
+	env.int("RESTQL_DATABASE_CIRCUIT_BREAKER_HALF_OPEN_REQUESTS", &cfg.CircuitBreaker.HalfOpenRequests)
+
+	if len(env.problems) > 0 {
+		// the settings that were parsed are validated too, so every problem is
+		// reported at once, the invalid ones keeping their previous value
+		problems := env.problems
+		var configErr *ConfigError
+		if errors.As(cfg.Validate(), &configErr) {
+			problems = append(problems, configErr.Problems...)
+		}
+		return Config{}, &ConfigError{Problems: problems}
+	}
+
+	return cfg, nil
+}
+
+func loadConfigFile(path string, cfg *Config) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to read configuration file")
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, cfg)
+	case ".json":
+		err = json.Unmarshal(content, cfg)
+	default:
+		return errors.Errorf("unsupported configuration file extension: %s", path)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to decode configuration file %s", path)
+	}
+
+	return nil
+}
+
+// Validate checks every setting and reports all problems at once in a *ConfigError.
+func (c Config) Validate() error {
+	var problems []string
+
+	if c.ConnectionString == "" && c.Credentials.ConnectionStringFile == "" {
+		problems = append(problems, "connection string is required")
+	}
+	if c.ConnectionString != "" && c.Credentials.ConnectionStringFile != "" {
+		problems = append(problems, "connection string and connection string file are mutually exclusive")
+	}
+	if (c.TLS.CertificateFile == "") != (c.TLS.KeyFile == "") {
+		problems = append(problems, "tls certificate file and key file must be set together")
+	}
+	if strings.EqualFold(c.AuthMechanism, x509AuthMechanism) && c.TLS.CertificateFile == "" {
+		problems = append(problems, "MONGODB-X509 authentication requires a tls certificate file")
+	}
+	if c.watchesFiles() && c.Credentials.ReloadInterval <= 0 {
+		problems = append(problems, "credentials reload interval must be positive")
+	}
+	if c.DatabaseName == "" {
+		problems = append(problems, "database name is required")
+	}
+	if c.MaxPoolSize != 0 && c.MinPoolSize > c.MaxPoolSize {
+		problems = append(problems, fmt.Sprintf("min pool size %d is greater than max pool size %d", c.MinPoolSize, c.MaxPoolSize))
+	}
+	if c.ReadPreference != "" {
+		if _, err := readpref.ModeFromString(c.ReadPreference); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid read preference %q", c.ReadPreference))
+		}
+	}
+	if c.WriteConcern != "" {
+		if _, err := parseWriteConcern(c.WriteConcern); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	for _, compressor := range c.Compressors {
+		if _, ok := supportedCompressors[compressor]; !ok {
+			problems = append(problems, fmt.Sprintf("unsupported compressor %q", compressor))
+		}
+	}
+
+	if c.ConnectionTimeout <= 0 {
+		problems = append(problems, "connection timeout must be positive")
+	}
+	if c.MappingsReadTimeout < 0 {
+		problems = append(problems, "mappings read timeout must not be negative")
+	}
+	if c.QueryReadTimeout < 0 {
+		problems = append(problems, "query read timeout must not be negative")
+	}
+	if c.WriteTimeout < 0 {
+		problems = append(problems, "write timeout must not be negative")
+	}
+	if c.RevisionsCollection == "query" || c.RevisionsCollection == "tenant" {
+		problems = append(problems, fmt.Sprintf("revisions collection must not be the %s collection", c.RevisionsCollection))
+	}
+	switch c.RevisionDeduplication {
+	case "", DeduplicateExact, DeduplicateWhitespace:
+	default:
+		problems = append(problems, fmt.Sprintf("unsupported revision deduplication %q", c.RevisionDeduplication))
+	}
+	if c.Indexes.Strict && c.LazyConnect {
+		problems = append(problems, "strict indexes require connecting on startup, disable lazy connect")
+	}
+	if c.Indexes.Strict && c.Snapshot.Path != "" {
+		problems = append(problems, "strict indexes require connecting on startup, disable the snapshot")
+	}
+	if c.LatestRevision > 0 {
+		problems = append(problems, "latest revision sentinel must not be a positive revision number")
+	}
+	if c.HandleSignals && c.ShutdownTimeout <= 0 {
+		problems = append(problems, "shutdown timeout must be positive")
+	}
+
+	if c.Cache.MaxEntries < 0 {
+		problems = append(problems, "cache max entries must not be negative")
+	}
+	if c.Cache.MaxEntries > 0 && c.Cache.MappingsTTL <= 0 {
+		problems = append(problems, "cache mappings ttl must be positive")
+	}
+	if c.Cache.MaxEntries > 0 && c.Cache.QueryTTL <= 0 {
+		problems = append(problems, "cache query ttl must be positive")
+	}
+	if c.Cache.MaxEntries > 0 && c.Cache.LatestQueryTTL <= 0 {
+		problems = append(problems, "cache latest query ttl must be positive")
+	}
+	if c.Snapshot.Path != "" && c.Snapshot.FlushInterval <= 0 {
+		problems = append(problems, "snapshot flush interval must be positive")
+	}
+
+	if c.Retry.MaxAttempts < 1 {
+		problems = append(problems, "retry max attempts must be at least 1")
+	}
+	if c.Retry.MaxAttempts > 1 && c.Retry.BaseBackoff <= 0 {
+		problems = append(problems, "retry base backoff must be positive")
+	}
+	if c.Retry.MaxBackoff < c.Retry.BaseBackoff {
+		problems = append(problems, "retry max backoff must not be less than the base backoff")
+	}
+	if c.Retry.Jitter < 0 || c.Retry.Jitter > 1 {
+		problems = append(problems, "retry jitter must be between 0 and 1")
+	}
+
+	if cb := c.CircuitBreaker; cb.Enabled {
+		if cb.FailureRateThreshold <= 0 || cb.FailureRateThreshold > 1 {
+			problems = append(problems, "circuit breaker failure rate threshold must be greater than 0 and at most 1")
+		}
+		if cb.MinimumRequests < 1 {
+			problems = append(problems, "circuit breaker minimum requests must be at least 1")
+		}
+		if cb.Window <= 0 {
+			problems = append(problems, "circuit breaker window must be positive")
+		}
+		if cb.OpenTimeout <= 0 {
+			problems = append(problems, "circuit breaker open timeout must be positive")
+		}
+		if cb.HalfOpenRequests < 1 {
+			problems = append(problems, "circuit breaker half-open requests must be at least 1")
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+
+	return nil
+}
+
+func (c Config) clientOptions() *options.ClientOptions {
+	opts := options.Client().
+		ApplyURI(c.ConnectionString).
+		SetConnectTimeout(time.Duration(c.ConnectionTimeout))
+
+	if c.AppName != "" {
+		opts.SetAppName(c.AppName)
+	}
+	if c.MinPoolSize > 0 {
+		opts.SetMinPoolSize(c.MinPoolSize)
+	}
+	if c.MaxPoolSize > 0 {
+		opts.SetMaxPoolSize(c.MaxPoolSize)
+	}
+	if c.ReadPreference != "" {
+		mode, _ := readpref.ModeFromString(c.ReadPreference)
+		rp, _ := readpref.New(mode)
+		opts.SetReadPreference(rp)
+	}
+	if c.WriteConcern != "" {
+		wc, _ := parseWriteConcern(c.WriteConcern)
+		opts.SetWriteConcern(wc)
+	}
+	if len(c.Compressors) > 0 {
+		opts.SetCompressors(c.Compressors)
+	}
+	if c.username != "" || c.password != "" || c.AuthMechanism != "" {
+		var cred options.Credential
+		if opts.Auth != nil {
+			cred = *opts.Auth
+		}
+		if c.AuthMechanism != "" {
+			cred.AuthMechanism = c.AuthMechanism
+		}
+		if c.username != "" {
+			cred.Username = c.username
+		}
+		if c.password != "" {
+			cred.Password = c.password
+			cred.PasswordSet = true
+		}
+		opts.SetAuth(cred)
+	}
+
+	return opts
+}
+
+// resolveCredentials returns a copy of the configuration with the
+// connection string and credentials read from their files.
+func (c Config) resolveCredentials() (Config, error) {
+	cc := c.Credentials
+	if cc.ConnectionStringFile != "" {
+		content, err := readSecretFile(cc.ConnectionStringFile)
+		if err != nil {
+			return Config{}, err
+		}
+		c.ConnectionString = content
+	}
+	if cc.UsernameFile != "" {
+		content, err := readSecretFile(cc.UsernameFile)
+		if err != nil {
+			return Config{}, err
+		}
+		c.username = content
+	}
+	if cc.PasswordFile != "" {
+		content, err := readSecretFile(cc.PasswordFile)
+		if err != nil {
+			return Config{}, err
+		}
+		c.password = content
+	}
+	if c.TLS.CAFile != "" {
+		content, err := os.ReadFile(c.TLS.CAFile)
+		if err != nil {
+			return Config{}, errors.Wrap(err, "failed to read tls CA file")
+		}
+		c.caPEM = string(content)
+	}
+
+	return c, nil
+}
+
+func readSecretFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read credentials file")
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
+
+type credentials struct {
+	connectionString string
+	username         string
+	password         string
+	caPEM            string
+}
+
+func (c Config) credentials() credentials {
+	return credentials{connectionString: c.ConnectionString, username: c.username, password: c.password, caPEM: c.caPEM}
+}
+
+// redactError hides the connection string and the
+// password from errors returned by the driver.
+func (c Config) redactError(err error) error {
+	return c.credentials().redactError(err)
+}
+
+func (c credentials) redactError(err error) error {
+	err = redactError(err, c.connectionString)
+	if err == nil || c.password == "" {
+		return err
+	}
+
+	msg := replaceToken(err.Error(), c.password, redacted)
+	if msg == err.Error() {
+		return err
+	}
+
+	return &redactedError{err: err, msg: msg}
+}
+
+func parseWriteConcern(w string) (*writeconcern.WriteConcern, error) {
+	if w == "majority" {
+		return writeconcern.New(writeconcern.WMajority()), nil
+	}
+
+	n, err := strconv.Atoi(w)
+	if err != nil || n < 0 {
+		return nil, errors.Errorf("invalid write concern %q: expected \"majority\" or a non negative number", w)
+	}
+
+	return writeconcern.New(writeconcern.W(n)), nil
+}
+
+// envReader overrides configuration values with the environment
+// variables that are set, collecting every parsing problem.
+type envReader struct {
+	problems []string
+}
+
+func (er *envReader) lookup(name string) (string, bool) {
+	value, found := os.LookupEnv(name)
+	if !found || value == "" {
+		return "", false
+	}
+
+	return value, true
+}
+
+func (er *envReader) fail(name string, value string, err error) {
+	er.problems = append(er.problems, fmt.Sprintf("failed to parse %s=%q: %s", name, value, err))
+}
+
+func (er *envReader) string(name string, target *string) {
+	if value, found := er.lookup(name); found {
+		*target = value
+	}
+}
+
+func (er *envReader) list(name string, target *[]string) {
+	value, found := er.lookup(name)
+	if !found {
+		return
+	}
+
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	*target = items
+}
+
+func (er *envReader) bool(name string, target *bool) {
+	value, found := er.lookup(name)
+	if !found {
+		return
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		er.fail(name, value, err)
+		return
+	}
+	*target = parsed
+}
+
+func (er *envReader) int(name string, target *int) {
+	value, found := er.lookup(name)
+	if !found {
+		return
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		er.fail(name, value, err)
+		return
+	}
+	*target = parsed
+}
+
+func (er *envReader) uint(name string, target *uint64) {
+	value, found := er.lookup(name)
+	if !found {
+		return
+	}
+
+	parsed, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		er.fail(name, value, err)
+		return
+	}
+	*target = parsed
+}
+
+func (er *envReader) float(name string, target *float64) {
+	value, found := er.lookup(name)
+	if !found {
+		return
+	}
+
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		er.fail(name, value, err)
+		return
+	}
+	*target = parsed
+}
+
+func (er *envReader) duration(name string, target *Duration) {
+	value, found := er.lookup(name)
+	if !found {
+		return
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		er.fail(name, value, err)
+		return
+	}
+	*target = Duration(parsed)
+}
@@ -0,0 +1,264 @@
+package restql_mongodb
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func validConfig() Config {
+	cfg := DefaultConfig()
+	cfg.ConnectionString = "mongodb://localhost:27017/restql"
+	cfg.DatabaseName = "restql"
+
+	return cfg
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   func(cfg *Config)
+		problems []string
+	}{
+		{
+			name:   "valid",
+			change: func(cfg *Config) {},
+		},
+		{
+			name: "connection",
+			change: func(cfg *Config) {
+				cfg.ConnectionString = ""
+				cfg.DatabaseName = ""
+				cfg.MinPoolSize = 20
+				cfg.MaxPoolSize = 10
+			},
+			problems: []string{
+				"connection string is required",
+				"database name is required",
+				"min pool size 20 is greater than max pool size 10",
+			},
+		},
+		{
+			name: "connection string from both sources",
+			change: func(cfg *Config) {
+				cfg.Credentials.ConnectionStringFile = "/run/secrets/mongodb-uri"
+				cfg.Credentials.ReloadInterval = 0
+			},
+			problems: []string{
+				"connection string and connection string file are mutually exclusive",
+				"credentials reload interval must be positive",
+			},
+		},
+		{
+			name: "tls and authentication",
+			change: func(cfg *Config) {
+				cfg.TLS.KeyFile = "/etc/ssl/client.key"
+				cfg.AuthMechanism = "mongodb-x509"
+			},
+			problems: []string{
+				"tls certificate file and key file must be set together",
+				"MONGODB-X509 authentication requires a tls certificate file",
+			},
+		},
+		{
+			name: "client options",
+			change: func(cfg *Config) {
+				cfg.ReadPreference = "closest"
+				cfg.WriteConcern = "all"
+				cfg.Compressors = []string{"zstd", "lz4"}
+			},
+			problems: []string{
+				`invalid read preference "closest"`,
+				`invalid write concern "all": expected "majority" or a non negative number`,
+				`unsupported compressor "lz4"`,
+			},
+		},
+		{
+			name: "timeouts",
+			change: func(cfg *Config) {
+				cfg.ConnectionTimeout = 0
+				cfg.MappingsReadTimeout = Duration(-time.Second)
+				cfg.QueryReadTimeout = Duration(-time.Second)
+				cfg.WriteTimeout = Duration(-time.Second)
+				cfg.HandleSignals = true
+				cfg.ShutdownTimeout = 0
+			},
+			problems: []string{
+				"connection timeout must be positive",
+				"mappings read timeout must not be negative",
+				"query read timeout must not be negative",
+				"write timeout must not be negative",
+				"shutdown timeout must be positive",
+			},
+		},
+		{
+			name: "revisions",
+			change: func(cfg *Config) {
+				cfg.RevisionsCollection = "query"
+				cfg.RevisionDeduplication = "fuzzy"
+				cfg.LatestRevision = 1
+			},
+			problems: []string{
+				"revisions collection must not be the query collection",
+				`unsupported revision deduplication "fuzzy"`,
+				"latest revision sentinel must not be a positive revision number",
+			},
+		},
+		{
+			name: "strict indexes with lazy connect",
+			change: func(cfg *Config) {
+				cfg.Indexes.Strict = true
+				cfg.LazyConnect = true
+			},
+			problems: []string{
+				"strict indexes require connecting on startup, disable lazy connect",
+			},
+		},
+		{
+			name: "strict indexes with a snapshot",
+			change: func(cfg *Config) {
+				cfg.Indexes.Strict = true
+				cfg.Snapshot.Path = "/var/lib/restql/snapshot.json"
+			},
+			problems: []string{
+				"strict indexes require connecting on startup, disable the snapshot",
+			},
+		},
+		{
+			name: "cache and snapshot",
+			change: func(cfg *Config) {
+				cfg.Cache.MaxEntries = 100
+				cfg.Cache.MappingsTTL = 0
+				cfg.Cache.QueryTTL = 0
+				cfg.Cache.LatestQueryTTL = 0
+				cfg.Snapshot.Path = "/var/lib/restql/snapshot.json"
+				cfg.Snapshot.FlushInterval = 0
+			},
+			problems: []string{
+				"cache mappings ttl must be positive",
+				"cache query ttl must be positive",
+				"cache latest query ttl must be positive",
+				"snapshot flush interval must be positive",
+			},
+		},
+		{
+			name: "retry",
+			change: func(cfg *Config) {
+				cfg.Retry.MaxAttempts = 3
+				cfg.Retry.BaseBackoff = 0
+				cfg.Retry.MaxBackoff = Duration(-time.Second)
+				cfg.Retry.Jitter = 1.5
+			},
+			problems: []string{
+				"retry base backoff must be positive",
+				"retry max backoff must not be less than the base backoff",
+				"retry jitter must be between 0 and 1",
+			},
+		},
+		{
+			name: "circuit breaker",
+			change: func(cfg *Config) {
+				cfg.CircuitBreaker = CircuitBreakerConfig{Enabled: true}
+			},
+			problems: []string{
+				"circuit breaker failure rate threshold must be greater than 0 and at most 1",
+				"circuit breaker minimum requests must be at least 1",
+				"circuit breaker window must be positive",
+				"circuit breaker open timeout must be positive",
+				"circuit breaker half-open requests must be at least 1",
+			},
+		},
+		{
+			name: "disabled circuit breaker is not validated",
+			change: func(cfg *Config) {
+				cfg.CircuitBreaker = CircuitBreakerConfig{}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			tt.change(&cfg)
+
+			err := cfg.Validate()
+			if tt.problems == nil {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+
+			var configErr *ConfigError
+			if !errors.As(err, &configErr) {
+				t.Fatalf("Validate() = %v, want a *ConfigError", err)
+			}
+			if !reflect.DeepEqual(configErr.Problems, tt.problems) {
+				t.Errorf("Validate() problems = %q, want %q", configErr.Problems, tt.problems)
+			}
+		})
+	}
+}
+
+func TestLoadConfigReportsEveryInvalidVariable(t *testing.T) {
+	env := map[string]string{
+		"RESTQL_DATABASE_CONFIG_FILE":        "",
+		"RESTQL_DATABASE_CONNECTION_STRING":  "mongodb://localhost:27017/restql",
+		"RESTQL_DATABASE_NAME":               "",
+		"RESTQL_DATABASE_WRITE_TIMEOUT":      "-1s",
+		"RESTQL_DATABASE_MAX_POOL_SIZE":      "-1",
+		"RESTQL_DATABASE_LAZY_CONNECT":       "maybe",
+		"RESTQL_DATABASE_QUERY_READ_TIMEOUT": "soon",
+		"RESTQL_DATABASE_CACHE_MAX_ENTRIES":  "many",
+	}
+	for name, value := range env {
+		setEnv(t, name, value)
+	}
+
+	_, err := LoadConfig()
+
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("LoadConfig() = %v, want a *ConfigError", err)
+	}
+
+	want := []string{
+		"RESTQL_DATABASE_MAX_POOL_SIZE",
+		"RESTQL_DATABASE_LAZY_CONNECT",
+		"RESTQL_DATABASE_QUERY_READ_TIMEOUT",
+		"RESTQL_DATABASE_CACHE_MAX_ENTRIES",
+	}
+	invalid := []string{
+		"database name is required",
+		"write timeout must not be negative",
+	}
+	if len(configErr.Problems) != len(want)+len(invalid) {
+		t.Fatalf("LoadConfig() problems = %q, want one for each of %q followed by %q", configErr.Problems, want, invalid)
+	}
+	for i, name := range want {
+		if !strings.Contains(configErr.Problems[i], name) {
+			t.Errorf("LoadConfig() problem %d = %q, want it about %s", i, configErr.Problems[i], name)
+		}
+	}
+	if got := configErr.Problems[len(want):]; !reflect.DeepEqual(got, invalid) {
+		t.Errorf("LoadConfig() validation problems = %q, want %q", got, invalid)
+	}
+}
+
+// setEnv sets an environment variable for the duration of the test.
+func setEnv(t *testing.T, name string, value string) {
+	previous, found := os.LookupEnv(name)
+	t.Cleanup(func() {
+		if found {
+			os.Setenv(name, previous)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+
+	os.Setenv(name, value)
+}
@@ -0,0 +1,222 @@
+package restql_mongodb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/b2wdigital/restQL-golang/v6/pkg/restql"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	connectMinBackoff = 500 * time.Millisecond
+	connectMaxBackoff = 30 * time.Second
+)
+
+// ErrDatabaseNotReady is returned by every database call made
+// before the background connection is established.
+var ErrDatabaseNotReady = fmt.Errorf("%w: database not ready", restql.ErrDatabaseCommunicationFailed)
+
+type clientRef struct {
+	client      *mongo.Client
+	credentials credentials
+	inFlight    sync.WaitGroup
+}
+
+// connection holds the current client and tracks
+// the operations in flight using each client.
+type connection struct {
+	mu      sync.RWMutex
+	current *clientRef
+	closed  bool
+}
+
+// swap replaces the current client and the credentials it was built with,
+// returning the previous one so the caller can drain it before disconnecting.
+func (c *connection) swap(client *mongo.Client, creds credentials) *clientRef {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	previous := c.current
+	c.current = &clientRef{client: client, credentials: creds}
+
+	return previous
+}
+
+// credentials returns the credentials of the current client, if any.
+func (c *connection) credentials() (credentials, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.current == nil {
+		return credentials{}, false
+	}
+
+	return c.current.credentials, true
+}
+
+func (c *connection) get() *mongo.Client {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.current == nil {
+		return nil
+	}
+
+	return c.current.client
+}
+
+// acquire returns the current client and a function that must be
+// called once the caller is done using it.
+func (c *connection) acquire() (*mongo.Client, func(), error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.closed {
+		return nil, nil, ErrDatabaseClosed
+	}
+	if c.current == nil {
+		return nil, nil, ErrDatabaseNotReady
+	}
+
+	c.current.inFlight.Add(1)
+	return c.current.client, c.current.inFlight.Done, nil
+}
+
+// close rejects new operations and returns the current client, if any.
+func (c *connection) close() *clientRef {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current := c.current
+	c.current = nil
+	c.closed = true
+
+	return current
+}
+
+// drain waits for the operations in flight on the client to finish
+// and then disconnects it.
+func (cr *clientRef) drain(ctx context.Context) error {
+	cr.inFlight.Wait()
+	return cr.client.Disconnect(ctx)
+}
+
+// clientOptions builds the driver options, cfg must have
+// its credentials already resolved.
+func (md *mongoDatabase) clientOptions(cfg Config) (*options.ClientOptions, error) {
+	opts := cfg.clientOptions()
+
+	if cfg.TLS.enabled() {
+		tlsCfg, err := md.tlsConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsCfg)
+	}
+
+	return opts, nil
+}
+
+// connect creates a client and pings the database, cfg must have its
+// credentials already resolved.
+func (md *mongoDatabase) connect(ctx context.Context, cfg Config) (*mongo.Client, error) {
+	opts, err := md.clientOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.ConnectionTimeout))
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, cfg.redactError(err)
+	}
+
+	err = client.Ping(ctx, nil)
+	if err != nil {
+		client.Disconnect(context.Background())
+		return nil, cfg.redactError(err)
+	}
+
+	return client, nil
+}
+
+// connectInBackground retries the connection with exponential
+// backoff until it succeeds or the context is cancelled.
+func (md *mongoDatabase) connectInBackground(ctx context.Context, onConnected func(ctx context.Context)) {
+	backoff := connectMinBackoff
+
+	for attempt := 1; ; attempt++ {
+		cfg, err := md.config.resolveCredentials()
+		if err == nil {
+			var client *mongo.Client
+			client, err = md.connect(ctx, cfg)
+			if err == nil {
+				md.conn.swap(client, cfg.credentials())
+				md.logger.Info("database connection established", "url", redactConnectionString(cfg.ConnectionString), "attempts", attempt)
+				onConnected(ctx)
+				return
+			}
+		}
+
+		md.logger.Warn("database connection failed, retrying", "error", err.Error(), "attempt", attempt, "retryIn", backoff.String())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > connectMaxBackoff {
+			backoff = connectMaxBackoff
+		}
+	}
+}
+
+// Ready reports whether the database connection has been established.
+func (md *mongoDatabase) Ready() bool {
+	return md.conn.get() != nil
+}
+
+// HealthCheck pings the database, returning ErrDatabaseNotReady
+// while the connection is not established.
+func (md *mongoDatabase) HealthCheck(ctx context.Context) error {
+	client, release, err := md.conn.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	err = client.Ping(ctx, nil)
+	if err != nil {
+		err = md.redactError(err)
+		return fmt.Errorf("%w: %s", restql.ErrDatabaseCommunicationFailed, err)
+	}
+
+	return nil
+}
+
+func (md *mongoDatabase) collection(name string) (*mongo.Collection, func(), error) {
+	client, release, err := md.conn.acquire()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return client.Database(md.databaseName).Collection(name), release, nil
+}
+
+// redactError hides the credentials of the current client from errors, they
+// may have been read from files and so be missing from the configuration.
+func (md *mongoDatabase) redactError(err error) error {
+	if creds, ok := md.conn.credentials(); ok {
+		return creds.redactError(err)
+	}
+
+	return md.config.redactError(err)
+}
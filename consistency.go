@@ -0,0 +1,336 @@
+package restql_mongodb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/b2wdigital/restQL-golang/v6/pkg/restql"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ConsistencyReport lists the problems found on the stored documents.
+type ConsistencyReport struct {
+	Repair   bool
+	Queries  int
+	Tenants  int
+	Repaired int
+	Problems []ConsistencyProblem
+}
+
+// ConsistencyProblem describes a problem found on a document and whether it was repaired.
+type ConsistencyProblem struct {
+	Collection string
+	ID         string
+	Problem    string
+	Repaired   bool
+}
+
+func (cr *ConsistencyReport) add(collection string, id string, problem string, repaired bool) {
+	cr.Problems = append(cr.Problems, ConsistencyProblem{Collection: collection, ID: id, Problem: problem, Repaired: repaired})
+	if repaired {
+		cr.Repaired++
+	}
+}
+
+// CheckConsistency scans the query, revisions and tenant collections. With repair set,
+// the size of queries is fixed to match their revisions, dropping the text-less entries
+// padded past the end of the revisions by out of range archiving. The other problems
+// are only reported, as fixing them needs to know what the data should have been.
+// A query changed while it is repaired is reported as not repaired.
+func (md *mongoDatabase) CheckConsistency(ctx context.Context, repair bool) (ConsistencyReport, error) {
+	report := ConsistencyReport{Repair: repair}
+
+	err := md.checkQueries(ctx, &report, repair)
+	if err != nil {
+		return report, err
+	}
+
+	err = md.checkTenants(ctx, &report)
+	if err != nil {
+		return report, err
+	}
+
+	if report.Repaired > 0 {
+		md.cache.purgeQueries()
+	}
+
+	return report, nil
+}
+
+func (md *mongoDatabase) checkQueries(ctx context.Context, report *ConsistencyReport, repair bool) error {
+	collection, release, err := md.collection("query")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	var latest map[string]int
+	if md.separateRevisions() {
+		latest, err = md.checkSeparateRevisions(ctx, collection, report)
+		if err != nil {
+			return err
+		}
+	}
+
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return errors.Wrap(err, "failed to list queries to check")
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		report.Queries++
+
+		doc := cursor.Current
+		namespace, _ := doc.Lookup("namespace").StringValueOK()
+		name, _ := doc.Lookup("name").StringValueOK()
+		id := namespace + "/" + name
+
+		size, ok := rawInt(doc.Lookup("size"))
+		if !ok {
+			report.add("query", id, "size is missing or not a number", false)
+			continue
+		}
+
+		revisions, hasRevisions := doc.Lookup("revisions").ArrayOK()
+		if md.separateRevisions() {
+			if hasRevisions {
+				report.add("query", id, "revisions are still embedded, run migrate-revisions", false)
+				continue
+			}
+
+			if size != latest[id] {
+				problem := fmt.Sprintf("size %d does not match the latest stored revision %d", size, latest[id])
+				repaired, err := md.repairSize(ctx, collection, doc, size, latest[id], nil, repair)
+				if err != nil {
+					return err
+				}
+				report.add("query", id, problem, repaired)
+			}
+			continue
+		}
+
+		if !hasRevisions {
+			if size != 0 {
+				report.add("query", id, "revisions are missing", false)
+			}
+			continue
+		}
+
+		values, err := revisions.Values()
+		if err != nil {
+			report.add("query", id, fmt.Sprintf("revisions cannot be decoded: %s", err), false)
+			continue
+		}
+
+		keep := createdRevisions(values, size)
+
+		for i, v := range values[:keep] {
+			if problem := revisionProblem(v); problem != "" {
+				report.add("query", id, fmt.Sprintf("revision %d %s", i+1, problem), false)
+			}
+		}
+
+		if keep != len(values) || keep != size {
+			problem := fmt.Sprintf("size %d does not match its %d revisions", size, keep)
+			if keep != len(values) {
+				problem = fmt.Sprintf("%s, %d padded entries after them", problem, len(values)-keep)
+			}
+
+			repaired, err := md.repairSize(ctx, collection, doc, size, keep, values, repair)
+			if err != nil {
+				return err
+			}
+			report.add("query", id, problem, repaired)
+		}
+	}
+
+	err = cursor.Err()
+	if err != nil {
+		return errors.Wrap(err, "failed to list queries to check")
+	}
+
+	return nil
+}
+
+// checkSeparateRevisions reports the invalid documents of the revisions collection
+// and returns the latest revision number stored for each query.
+func (md *mongoDatabase) checkSeparateRevisions(ctx context.Context, collection *mongo.Collection, report *ConsistencyReport) (map[string]int, error) {
+	cursor, err := md.revisions(collection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list revisions to check")
+	}
+	defer cursor.Close(ctx)
+
+	latest := make(map[string]int)
+	for cursor.Next(ctx) {
+		doc := cursor.Current
+		namespace, _ := doc.Lookup("namespace").StringValueOK()
+		name, _ := doc.Lookup("name").StringValueOK()
+		id := namespace + "/" + name
+
+		number, ok := rawInt(doc.Lookup("revision"))
+		if !ok || number < 1 {
+			report.add(md.config.RevisionsCollection, id, "revision number is missing or invalid", false)
+			continue
+		}
+
+		if problem := revisionProblem(bson.RawValue{Type: bsontype.EmbeddedDocument, Value: doc}); problem != "" {
+			report.add(md.config.RevisionsCollection, fmt.Sprintf("%s/%d", id, number), problem, false)
+		}
+
+		if number > latest[id] {
+			latest[id] = number
+		}
+	}
+
+	err = cursor.Err()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list revisions to check")
+	}
+
+	return latest, nil
+}
+
+// repairSize sets the size of the query, trimming the revisions to it when given.
+// It only matches the document as it was read.
+func (md *mongoDatabase) repairSize(ctx context.Context, collection *mongo.Collection, doc bson.Raw, size int, fixed int, revisions []bson.RawValue, repair bool) (bool, error) {
+	if !repair {
+		return false, nil
+	}
+
+	filter := bson.M{"_id": doc.Lookup("_id"), "size": size}
+	update := bson.M{"$set": bson.M{"size": fixed}}
+	if revisions != nil {
+		filter["revisions"] = bson.M{"$size": len(revisions)}
+		update["$push"] = bson.M{"revisions": bson.M{"$each": bson.A{}, "$slice": fixed}}
+	}
+
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to repair query size")
+	}
+
+	return result.MatchedCount > 0, nil
+}
+
+func (md *mongoDatabase) checkTenants(ctx context.Context, report *ConsistencyReport) error {
+	collection, release, err := md.collection("tenant")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return errors.Wrap(err, "failed to list tenants to check")
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		report.Tenants++
+
+		id := fmt.Sprint(cursor.Current.Lookup("_id"))
+		if tenantID, ok := cursor.Current.Lookup("_id").StringValueOK(); ok {
+			id = tenantID
+		}
+
+		mappings, ok := cursor.Current.Lookup("mappings").DocumentOK()
+		if !ok {
+			report.add("tenant", id, "mappings are missing or not a document", false)
+			continue
+		}
+
+		elements, err := mappings.Elements()
+		if err != nil {
+			report.add("tenant", id, fmt.Sprintf("mappings cannot be decoded: %s", err), false)
+			continue
+		}
+
+		for _, e := range elements {
+			url, ok := e.Value().StringValueOK()
+			if !ok {
+				report.add("tenant", id, fmt.Sprintf("mapping %s is a %s, not a string", e.Key(), e.Value().Type), false)
+				continue
+			}
+
+			_, err := restql.NewMapping(e.Key(), url)
+			if err != nil {
+				report.add("tenant", id, fmt.Sprintf("mapping %s is invalid: %s", e.Key(), err), false)
+			}
+		}
+	}
+
+	err = cursor.Err()
+	if err != nil {
+		return errors.Wrap(err, "failed to list tenants to check")
+	}
+
+	return nil
+}
+
+// rawInt reads a number stored as any of the numeric types.
+func rawInt(v bson.RawValue) (int, bool) {
+	if n, ok := v.Int32OK(); ok {
+		return int(n), true
+	}
+	if n, ok := v.Int64OK(); ok {
+		return int(n), true
+	}
+	if n, ok := v.DoubleOK(); ok {
+		return int(n), n == float64(int(n))
+	}
+
+	return 0, false
+}
+
+// createdRevisions returns how many of the revisions were created, dropping the
+// entries past the size without a text, padded by archiving out of range revisions.
+func createdRevisions(values []bson.RawValue, size int) int {
+	keep := len(values)
+	for keep > 0 && keep > size && !hasText(values[keep-1]) {
+		keep--
+	}
+
+	return keep
+}
+
+func hasText(v bson.RawValue) bool {
+	doc, ok := v.DocumentOK()
+	if !ok {
+		return false
+	}
+
+	_, err := doc.LookupErr("text")
+	return err == nil
+}
+
+// revisionProblem describes what keeps the revision from being served, if anything.
+func revisionProblem(v bson.RawValue) string {
+	if v.Type == bsontype.Null {
+		return "is null"
+	}
+
+	doc, ok := v.DocumentOK()
+	if !ok {
+		return fmt.Sprintf("is a %s, not a document", v.Type)
+	}
+
+	text, ok := doc.Lookup("text").StringValueOK()
+	switch {
+	case !ok:
+		return "has no text"
+	case text == "":
+		return "has an empty text"
+	}
+
+	archived := doc.Lookup("archived")
+	if archived.Type != 0 && archived.Type != bsontype.Null && archived.Type != bsontype.Boolean {
+		return fmt.Sprintf("archived is a %s, not a boolean", archived.Type)
+	}
+
+	return ""
+}
@@ -0,0 +1,111 @@
+package restql_mongodb
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestRawInt(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  interface{}
+		want   int
+		wantOK bool
+	}{
+		{name: "int32", value: int32(3), want: 3, wantOK: true},
+		{name: "int64", value: int64(3), want: 3, wantOK: true},
+		{name: "whole double", value: 3.0, want: 3, wantOK: true},
+		{name: "fractional double", value: 3.5, want: 3, wantOK: false},
+		{name: "string", value: "3", wantOK: false},
+		{name: "null", value: nil, wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := rawInt(rawValue(t, tt.value))
+			if ok != tt.wantOK || (ok && got != tt.want) {
+				t.Errorf("rawInt(%v) = %d, %t, want %d, %t", tt.value, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+
+	if _, ok := rawInt(bson.RawValue{}); ok {
+		t.Error("rawInt of a missing field reported a number")
+	}
+}
+
+func TestRevisionProblem(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{name: "valid", value: bson.M{"text": "from hero", "archived": false}},
+		{name: "without archived", value: bson.M{"text": "from hero"}},
+		{name: "null archived", value: bson.M{"text": "from hero", "archived": nil}},
+		{name: "null entry", value: nil, want: "is null"},
+		{name: "not a document", value: "from hero", want: "is a string, not a document"},
+		{name: "without text", value: bson.M{"archived": true}, want: "has no text"},
+		{name: "text not a string", value: bson.M{"text": 42}, want: "has no text"},
+		{name: "empty text", value: bson.M{"text": ""}, want: "has an empty text"},
+		{name: "archived not a boolean", value: bson.M{"text": "from hero", "archived": "yes"}, want: "archived is a string, not a boolean"},
+		{name: "archived as a number", value: bson.M{"text": "from hero", "archived": int32(1)}, want: "archived is a 32-bit integer, not a boolean"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := revisionProblem(rawValue(t, tt.value))
+			if got != tt.want {
+				t.Errorf("revisionProblem(%v) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreatedRevisions(t *testing.T) {
+	created := bson.M{"text": "from hero"}
+	padding := bson.M{"archived": true}
+
+	tests := []struct {
+		name      string
+		revisions bson.A
+		size      int
+		want      int
+	}{
+		{name: "matching size", revisions: bson.A{created, created}, size: 2, want: 2},
+		{name: "no revisions", revisions: bson.A{}, size: 0, want: 0},
+		{name: "padded tail past the size", revisions: bson.A{created, created, padding, padding}, size: 2, want: 2},
+		{name: "null padding past the size", revisions: bson.A{created, nil, padding}, size: 1, want: 1},
+		{name: "real revisions past the size", revisions: bson.A{created, created, created}, size: 1, want: 3},
+		{name: "padding before a real revision past the size", revisions: bson.A{created, padding, created}, size: 1, want: 3},
+		{name: "entries without text within the size", revisions: bson.A{created, padding, padding}, size: 3, want: 3},
+		{name: "size past the revisions", revisions: bson.A{created}, size: 3, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := rawValue(t, tt.revisions).Array().Values()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := createdRevisions(values, tt.size)
+			if got != tt.want {
+				t.Errorf("createdRevisions(%v, %d) = %d, want %d", tt.revisions, tt.size, got, tt.want)
+			}
+		})
+	}
+}
+
+// rawValue returns the value as it is read from a stored document.
+func rawValue(t *testing.T, value interface{}) bson.RawValue {
+	t.Helper()
+
+	doc, err := bson.Marshal(bson.M{"v": value})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bson.Raw(doc).Lookup("v")
+}
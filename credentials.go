@@ -0,0 +1,63 @@
+package restql_mongodb
+
+import (
+	"context"
+	"time"
+)
+
+// watchCredentials polls the credential and CA files and rebuilds the client
+// when their content changes. Calls in flight on the previous client are allowed
+// to finish before it is disconnected.
+func (md *mongoDatabase) watchCredentials(ctx context.Context) {
+	interval := time.Duration(md.config.Credentials.ReloadInterval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	md.logger.Info("watching database credential files", "interval", interval.String())
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			md.reloadCredentials(ctx)
+		}
+	}
+}
+
+func (md *mongoDatabase) reloadCredentials(ctx context.Context) {
+	cfg, err := md.config.resolveCredentials()
+	if err != nil {
+		md.logger.Error("failed to read database credential files", err)
+		return
+	}
+
+	if current, _ := md.conn.credentials(); cfg.credentials() == current {
+		return
+	}
+
+	md.logger.Info("database credentials changed, rebuilding client", "url", redactConnectionString(cfg.ConnectionString))
+
+	client, err := md.connect(ctx, cfg)
+	if err != nil {
+		md.logger.Error("failed to connect with the new database credentials, keeping the current client", err)
+		return
+	}
+
+	previous := md.conn.swap(client, cfg.credentials())
+
+	md.logger.Info("database client rebuilt with the new credentials")
+
+	if previous == nil {
+		return
+	}
+
+	go func() {
+		err := previous.drain(context.Background())
+		if err != nil {
+			md.logger.Error("failed to disconnect previous database client", cfg.redactError(err))
+			return
+		}
+		md.logger.Debug("previous database client drained and disconnected")
+	}()
+}
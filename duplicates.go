@@ -0,0 +1,382 @@
+package restql_mongodb
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MergeOptions controls a duplicates merge.
+type MergeOptions struct {
+	// DryRun only reports the duplicates, changing nothing.
+	DryRun bool
+	// Backup receives every affected document as canonical extended JSON,
+	// one per line, before any of them is changed. Required unless DryRun is set.
+	Backup io.Writer
+}
+
+// DuplicatesReport lists the duplicated queries found and how they were merged.
+type DuplicatesReport struct {
+	DryRun  bool
+	Groups  []DuplicateGroup
+	Merged  int
+	Skipped []string
+}
+
+// DuplicateGroup describes the documents of a duplicated query
+// and the document they are merged into.
+type DuplicateGroup struct {
+	Namespace       string
+	Name            string
+	Documents       []DuplicateDocument
+	CommonRevisions int
+	Differences     []string
+	MergedSize      int
+	MergedArchived  bool
+}
+
+// DuplicateDocument describes one of the documents of a duplicated query.
+// CreatedAt is only known for documents with generated ids.
+type DuplicateDocument struct {
+	ID        string
+	CreatedAt *time.Time `json:",omitempty"`
+	Size      int
+	Revisions int
+	Archived  bool
+}
+
+type duplicateDocument struct {
+	id        interface{}
+	raw       bson.Raw
+	createdAt *time.Time
+	query     query
+}
+
+type duplicateGroup struct {
+	report    DuplicateGroup
+	documents []duplicateDocument
+	merged    []revision
+}
+
+// MergeDuplicateQueries finds the query documents sharing a namespace and name
+// and merges each set into its oldest document, deleting the others.
+// The revisions every document has in common are kept once, followed by the
+// remaining revisions of every document in the order they were created.
+// A query changed before it is merged is skipped and reported, while one changed
+// in the middle of its merge stops the run with an error.
+func (md *mongoDatabase) MergeDuplicateQueries(ctx context.Context, opts MergeOptions) (DuplicatesReport, error) {
+	report := DuplicatesReport{DryRun: opts.DryRun}
+
+	if !opts.DryRun && opts.Backup == nil {
+		return report, errors.New("a backup is required to merge duplicated queries")
+	}
+
+	collection, release, err := md.collection("query")
+	if err != nil {
+		return report, err
+	}
+	defer release()
+
+	groups, err := md.findDuplicateQueries(ctx, collection)
+	if err != nil {
+		return report, err
+	}
+
+	for _, g := range groups {
+		report.Groups = append(report.Groups, g.report)
+	}
+
+	if opts.DryRun || len(groups) == 0 {
+		return report, nil
+	}
+
+	for _, g := range groups {
+		for _, doc := range g.documents {
+			err := writeBackup(opts.Backup, doc.raw)
+			if err != nil {
+				return report, errors.Wrap(err, "failed to write duplicated queries backup")
+			}
+		}
+	}
+
+	defer md.cache.purgeQueries()
+
+	for _, g := range groups {
+		merged, err := md.mergeDuplicateGroup(ctx, collection, g)
+		if err != nil {
+			return report, err
+		}
+
+		id := g.report.Namespace + "/" + g.report.Name
+		if !merged {
+			md.logger.Warn("query changed while merging duplicates, skipped", "namespace", g.report.Namespace, "name", g.report.Name)
+			report.Skipped = append(report.Skipped, id)
+			continue
+		}
+
+		report.Merged++
+		md.logger.Info("duplicated query merged", "namespace", g.report.Namespace, "name", g.report.Name, "documents", len(g.documents))
+	}
+
+	return report, nil
+}
+
+func (md *mongoDatabase) findDuplicateQueries(ctx context.Context, collection *mongo.Collection) ([]duplicateGroup, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"namespace": "$namespace", "name": "$name"},
+			"ids":   bson.M{"$push": "$_id"},
+			"count": bson.M{"$sum": 1},
+		}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id.namespace", Value: 1}, {Key: "_id.name", Value: 1}}}},
+	}
+
+	cursor, err := collection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find duplicated queries")
+	}
+
+	var found []struct {
+		IDs []interface{} `bson:"ids"`
+	}
+	err = cursor.All(ctx, &found)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find duplicated queries")
+	}
+
+	groups := make([]duplicateGroup, 0, len(found))
+	for _, f := range found {
+		g, err := md.loadDuplicateGroup(ctx, collection, f.IDs)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+
+	return groups, nil
+}
+
+func (md *mongoDatabase) loadDuplicateGroup(ctx context.Context, collection *mongo.Collection, ids []interface{}) (duplicateGroup, error) {
+	var g duplicateGroup
+
+	cursor, err := collection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return g, errors.Wrap(err, "failed to load duplicated queries")
+	}
+
+	var raws []bson.Raw
+	err = cursor.All(ctx, &raws)
+	if err != nil {
+		return g, errors.Wrap(err, "failed to load duplicated queries")
+	}
+
+	for _, raw := range raws {
+		doc := duplicateDocument{raw: raw}
+
+		id := raw.Lookup("_id")
+		err := id.Unmarshal(&doc.id)
+		if err != nil {
+			return g, errors.Wrap(err, "failed to decode duplicated query id")
+		}
+
+		err = bson.Unmarshal(raw, &doc.query)
+		if err != nil {
+			return g, errors.Wrapf(err, "failed to decode duplicated query %s", id)
+		}
+
+		if oid, ok := id.ObjectIDOK(); ok {
+			createdAt := oid.Timestamp().UTC()
+			doc.createdAt = &createdAt
+		}
+
+		g.documents = append(g.documents, doc)
+	}
+
+	// documents without a known creation time go last, in the order they were found
+	sort.SliceStable(g.documents, func(i, j int) bool {
+		a, b := g.documents[i].createdAt, g.documents[j].createdAt
+		return a != nil && (b == nil || a.Before(*b))
+	})
+
+	md.mergeDuplicateRevisions(&g)
+
+	return g, nil
+}
+
+// mergeDuplicateRevisions computes the merged document of the group and the differences
+// between its documents. With a revisions collection the documents only differ on their
+// size and archiving flag, the revisions being already shared.
+func (md *mongoDatabase) mergeDuplicateRevisions(g *duplicateGroup) {
+	first := g.documents[0].query
+	g.report.Namespace = first.Namespace
+	g.report.Name = first.Name
+	g.report.MergedArchived = true
+
+	common := len(first.Revisions)
+	for _, doc := range g.documents {
+		q := doc.query
+		g.report.Documents = append(g.report.Documents, DuplicateDocument{
+			ID:        duplicateID(doc.id),
+			CreatedAt: doc.createdAt,
+			Size:      q.Size,
+			Revisions: len(q.Revisions),
+			Archived:  q.Archived,
+		})
+
+		g.report.MergedArchived = g.report.MergedArchived && q.Archived
+		common = commonRevisions(first.Revisions[:common], q.Revisions)
+
+		if q.Archived != first.Archived {
+			g.report.Differences = append(g.report.Differences, fmt.Sprintf("document %s archived is %t", duplicateID(doc.id), q.Archived))
+		}
+		if !md.separateRevisions() && q.Size != len(q.Revisions) {
+			g.report.Differences = append(g.report.Differences, fmt.Sprintf("document %s size %d does not match its %d revisions", duplicateID(doc.id), q.Size, len(q.Revisions)))
+		}
+	}
+
+	if md.separateRevisions() {
+		for _, doc := range g.documents {
+			if doc.query.Size != first.Size {
+				g.report.Differences = append(g.report.Differences, fmt.Sprintf("document %s size is %d", duplicateID(doc.id), doc.query.Size))
+			}
+			if doc.query.Size > g.report.MergedSize {
+				g.report.MergedSize = doc.query.Size
+			}
+		}
+		return
+	}
+
+	g.report.CommonRevisions = common
+
+	// a revision shared by every document is only archived when archived in all of them
+	g.merged = make([]revision, common)
+	for i := 0; i < common; i++ {
+		g.merged[i] = first.Revisions[i]
+		for _, doc := range g.documents {
+			g.merged[i].Archived = g.merged[i].Archived && doc.query.Revisions[i].Archived
+		}
+	}
+
+	// the other revisions are ordered by their creation time when recorded,
+	// otherwise by the creation time of their document
+	type pendingRevision struct {
+		revision
+		createdAt *time.Time
+	}
+
+	var pending []pendingRevision
+	for _, doc := range g.documents {
+		extra := doc.query.Revisions[common:]
+		if len(extra) > 0 {
+			g.report.Differences = append(g.report.Differences, fmt.Sprintf("document %s has %d revisions after the common ones", duplicateID(doc.id), len(extra)))
+		}
+
+		for _, r := range extra {
+			p := pendingRevision{revision: r, createdAt: doc.createdAt}
+			if !r.CreatedAt.IsZero() {
+				createdAt := r.CreatedAt
+				p.createdAt = &createdAt
+			}
+			pending = append(pending, p)
+		}
+	}
+
+	sort.SliceStable(pending, func(i, j int) bool {
+		a, b := pending[i].createdAt, pending[j].createdAt
+		return a != nil && (b == nil || a.Before(*b))
+	})
+
+	for _, p := range pending {
+		g.merged = append(g.merged, p.revision)
+	}
+
+	g.report.MergedSize = len(g.merged)
+}
+
+// mergeDuplicateGroup updates the oldest document of the group and deletes the others,
+// returning false without writing anything when a document changed since it was loaded.
+// The update and the delete are not atomic, so a duplicate changed in between them
+// leaves the merge partial, which is returned as an error.
+func (md *mongoDatabase) mergeDuplicateGroup(ctx context.Context, collection *mongo.Collection, g duplicateGroup) (bool, error) {
+	keep := g.documents[0]
+
+	var loaded, others bson.A
+	for i, doc := range g.documents {
+		filter := bson.M{"_id": doc.id, "size": doc.query.Size}
+		loaded = append(loaded, filter)
+		if i > 0 {
+			others = append(others, filter)
+		}
+	}
+
+	unchanged, err := collection.CountDocuments(ctx, bson.M{"$or": loaded})
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to check duplicated query %s/%s", g.report.Namespace, g.report.Name)
+	}
+	if unchanged != int64(len(loaded)) {
+		return false, nil
+	}
+
+	set := bson.M{"size": g.report.MergedSize, "archived": g.report.MergedArchived}
+	if !md.separateRevisions() {
+		set["revisions"] = g.merged
+	}
+
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": keep.id, "size": keep.query.Size}, bson.M{"$set": set})
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to merge duplicated query %s/%s", g.report.Namespace, g.report.Name)
+	}
+	if result.MatchedCount == 0 {
+		return false, nil
+	}
+
+	deleted, err := collection.DeleteMany(ctx, bson.M{"$or": others})
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to delete duplicated query %s/%s, document %s already holds the merged revisions", g.report.Namespace, g.report.Name, duplicateID(keep.id))
+	}
+
+	if deleted.DeletedCount != int64(len(others)) {
+		return false, errors.Errorf(
+			"duplicated query %s/%s partially merged: document %s holds the merged revisions but %d of its duplicates changed meanwhile and were kept, restore the group from the backup",
+			g.report.Namespace, g.report.Name, duplicateID(keep.id), int64(len(others))-deleted.DeletedCount,
+		)
+	}
+
+	return true, nil
+}
+
+func commonRevisions(a []revision, b []revision) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n].Text == b[n].Text {
+		n++
+	}
+
+	return n
+}
+
+func duplicateID(id interface{}) string {
+	if oid, ok := id.(primitive.ObjectID); ok {
+		return oid.Hex()
+	}
+
+	return fmt.Sprint(id)
+}
+
+func writeBackup(w io.Writer, raw bson.Raw) error {
+	data, err := bson.MarshalExtJSON(raw, true, false)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,225 @@
+package restql_mongodb
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCommonRevisions(t *testing.T) {
+	tests := []struct {
+		name string
+		a    []string
+		b    []string
+		want int
+	}{
+		{name: "both empty", want: 0},
+		{name: "one empty", a: []string{"x"}, want: 0},
+		{name: "identical", a: []string{"x", "y"}, b: []string{"x", "y"}, want: 2},
+		{name: "prefix", a: []string{"x", "y", "z"}, b: []string{"x", "y"}, want: 2},
+		{name: "diverging", a: []string{"x", "y", "z"}, b: []string{"x", "w", "z"}, want: 1},
+		{name: "different first", a: []string{"x"}, b: []string{"w"}, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := commonRevisions(textRevisions(tt.a...), textRevisions(tt.b...))
+			if got != tt.want {
+				t.Errorf("commonRevisions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeDuplicateRevisions(t *testing.T) {
+	t0 := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+	t1, t2, t3 := t0.Add(time.Hour), t0.Add(2*time.Hour), t0.Add(3*time.Hour)
+
+	tests := []struct {
+		name        string
+		separate    bool
+		documents   []duplicateDocument
+		common      int
+		texts       []string
+		archived    []bool
+		size        int
+		allArchived bool
+		differences []string
+	}{
+		{
+			name: "identical documents",
+			documents: []duplicateDocument{
+				duplicateDoc("a", &t0, false, textRevisions("x", "y")...),
+				duplicateDoc("b", &t1, false, textRevisions("x", "y")...),
+			},
+			common:   2,
+			texts:    []string{"x", "y"},
+			archived: []bool{false, false},
+			size:     2,
+		},
+		{
+			name: "common prefix followed by the other revisions",
+			documents: []duplicateDocument{
+				duplicateDoc("a", &t0, false, textRevisions("x", "y", "z")...),
+				duplicateDoc("b", &t1, false, textRevisions("x", "y", "w")...),
+				duplicateDoc("c", &t2, false, textRevisions("x", "y")...),
+			},
+			common:   2,
+			texts:    []string{"x", "y", "z", "w"},
+			archived: []bool{false, false, false, false},
+			size:     4,
+			differences: []string{
+				"document a has 1 revisions after the common ones",
+				"document b has 1 revisions after the common ones",
+			},
+		},
+		{
+			name: "shared revision archived only when archived in every document",
+			documents: []duplicateDocument{
+				duplicateDoc("a", &t0, true, revision{Text: "x", Archived: true}, revision{Text: "y", Archived: true}),
+				duplicateDoc("b", &t1, false, revision{Text: "x", Archived: true}, revision{Text: "y"}),
+			},
+			common:      2,
+			texts:       []string{"x", "y"},
+			archived:    []bool{true, false},
+			size:        2,
+			differences: []string{"document b archived is false"},
+		},
+		{
+			name: "archived query when every document is archived",
+			documents: []duplicateDocument{
+				duplicateDoc("a", &t0, true, textRevisions("x")...),
+				duplicateDoc("b", &t1, true, textRevisions("x")...),
+			},
+			common:      1,
+			texts:       []string{"x"},
+			archived:    []bool{false},
+			size:        1,
+			allArchived: true,
+		},
+		{
+			name: "other revisions ordered by their creation, then their document creation, unknown last",
+			documents: []duplicateDocument{
+				duplicateDoc("a", &t0, false, revision{Text: "x"}, revisionAt("a1", t2)),
+				duplicateDoc("b", &t1, false, revision{Text: "x"}, revision{Text: "b1"}),
+				duplicateDoc("c", nil, false, revision{Text: "x"}, revision{Text: "c1"}, revisionAt("c2", t3)),
+			},
+			common:   1,
+			texts:    []string{"x", "b1", "a1", "c2", "c1"},
+			archived: []bool{false, false, false, false, false},
+			size:     5,
+			differences: []string{
+				"document a has 1 revisions after the common ones",
+				"document b has 1 revisions after the common ones",
+				"document c has 2 revisions after the common ones",
+			},
+		},
+		{
+			name: "size not matching the revisions",
+			documents: []duplicateDocument{
+				duplicateDoc("a", &t0, false, textRevisions("x")...),
+				withSize(duplicateDoc("b", &t1, false, textRevisions("x")...), 3),
+			},
+			common:      1,
+			texts:       []string{"x"},
+			archived:    []bool{false},
+			size:        1,
+			differences: []string{"document b size 3 does not match its 1 revisions"},
+		},
+		{
+			name:     "separate revisions keep the largest size",
+			separate: true,
+			documents: []duplicateDocument{
+				withSize(duplicateDoc("a", &t0, false), 3),
+				withSize(duplicateDoc("b", &t1, false), 5),
+				withSize(duplicateDoc("c", &t2, false), 3),
+			},
+			size:        5,
+			differences: []string{"document b size is 5"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md := &mongoDatabase{}
+			if tt.separate {
+				md.config.RevisionsCollection = "revisions"
+			}
+
+			g := duplicateGroup{documents: tt.documents}
+			md.mergeDuplicateRevisions(&g)
+
+			var texts []string
+			var archived []bool
+			for _, r := range g.merged {
+				texts = append(texts, r.Text)
+				archived = append(archived, r.Archived)
+			}
+
+			if g.report.CommonRevisions != tt.common {
+				t.Errorf("CommonRevisions = %d, want %d", g.report.CommonRevisions, tt.common)
+			}
+			if !reflect.DeepEqual(texts, tt.texts) {
+				t.Errorf("merged texts = %q, want %q", texts, tt.texts)
+			}
+			if !reflect.DeepEqual(archived, tt.archived) {
+				t.Errorf("merged archived = %v, want %v", archived, tt.archived)
+			}
+			if g.report.MergedSize != tt.size {
+				t.Errorf("MergedSize = %d, want %d", g.report.MergedSize, tt.size)
+			}
+			if g.report.MergedArchived != tt.allArchived {
+				t.Errorf("MergedArchived = %t, want %t", g.report.MergedArchived, tt.allArchived)
+			}
+			if !reflect.DeepEqual(g.report.Differences, tt.differences) {
+				t.Errorf("Differences = %q, want %q", g.report.Differences, tt.differences)
+			}
+			if len(g.report.Documents) != len(tt.documents) {
+				t.Errorf("reported %d documents, want %d", len(g.report.Documents), len(tt.documents))
+			}
+		})
+	}
+}
+
+func TestMergeDuplicateRevisionsKeepsMetadata(t *testing.T) {
+	createdAt := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+	first := revision{Text: "x", Archived: true, RevisionMetadata: RevisionMetadata{CreatedAt: createdAt, Author: "alice", SHA256: "abc", Message: "first"}}
+
+	g := duplicateGroup{documents: []duplicateDocument{
+		duplicateDoc("a", &createdAt, false, first),
+		duplicateDoc("b", &createdAt, false, revision{Text: "x"}),
+	}}
+	(&mongoDatabase{}).mergeDuplicateRevisions(&g)
+
+	want := first
+	want.Archived = false
+	if !reflect.DeepEqual(g.merged, []revision{want}) {
+		t.Errorf("merged = %+v, want %+v", g.merged, []revision{want})
+	}
+}
+
+func duplicateDoc(id string, createdAt *time.Time, archived bool, revisions ...revision) duplicateDocument {
+	return duplicateDocument{
+		id:        id,
+		createdAt: createdAt,
+		query:     query{Namespace: "hero", Name: "fetch", Size: len(revisions), Archived: archived, Revisions: revisions},
+	}
+}
+
+func withSize(doc duplicateDocument, size int) duplicateDocument {
+	doc.query.Size = size
+	return doc
+}
+
+func textRevisions(texts ...string) []revision {
+	var revisions []revision
+	for _, text := range texts {
+		revisions = append(revisions, revision{Text: text})
+	}
+
+	return revisions
+}
+
+func revisionAt(text string, createdAt time.Time) revision {
+	return revision{Text: text, RevisionMetadata: RevisionMetadata{CreatedAt: createdAt}}
+}
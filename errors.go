@@ -0,0 +1,183 @@
+package restql_mongodb
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/b2wdigital/restQL-golang/v6/pkg/restql"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/auth"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// MongoDB server error codes
+const (
+	errCodeUnauthorized         = 13
+	errCodeAuthenticationFailed = 18
+	errCodeWriteConflict        = 112
+	errCodeDuplicateKey         = 11000
+)
+
+// ErrRevisionNotFound is returned when archiving a revision the query does not have.
+// It matches restql.ErrQueryNotFoundInDatabase.
+var ErrRevisionNotFound = fmt.Errorf("%w: revision not found", restql.ErrQueryNotFoundInDatabase)
+
+// TimeoutError is returned when a database operation does not finish
+// within its timeout. It matches restql.ErrDatabaseCommunicationFailed.
+type TimeoutError struct {
+	Operation string
+	Timeout   time.Duration
+	Err       error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s: %s timed out after %s: %s", restql.ErrDatabaseCommunicationFailed, e.Operation, e.Timeout, e.Err)
+}
+
+func (e *TimeoutError) Is(target error) bool { return target == restql.ErrDatabaseCommunicationFailed }
+func (e *TimeoutError) Unwrap() error        { return e.Err }
+
+// AuthenticationError is returned when the server rejects the credentials
+// or their permissions. It matches restql.ErrDatabaseCommunicationFailed.
+type AuthenticationError struct {
+	Operation string
+	Err       error
+}
+
+func (e *AuthenticationError) Error() string {
+	return fmt.Sprintf("%s: %s not authorized: %s", restql.ErrDatabaseCommunicationFailed, e.Operation, e.Err)
+}
+
+func (e *AuthenticationError) Is(target error) bool {
+	return target == restql.ErrDatabaseCommunicationFailed
+}
+func (e *AuthenticationError) Unwrap() error { return e.Err }
+
+// UnavailableError is returned when the database cannot be reached, such as
+// on network failures, while no primary is elected, before the connection is
+// established or while the circuit breaker is open.
+// It matches restql.ErrDatabaseCommunicationFailed.
+type UnavailableError struct {
+	Operation string
+	Err       error
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("%s: %s failed, database unavailable: %s", restql.ErrDatabaseCommunicationFailed, e.Operation, e.Err)
+}
+
+func (e *UnavailableError) Is(target error) bool {
+	return target == restql.ErrDatabaseCommunicationFailed
+}
+func (e *UnavailableError) Unwrap() error { return e.Err }
+
+// CorruptDocumentError is returned when a stored document cannot be decoded
+// or is inconsistent. It matches the restql sentinel of the missing data,
+// restql.ErrMappingsNotFoundInDatabase for tenants and
+// restql.ErrQueryNotFoundInDatabase for queries.
+type CorruptDocumentError struct {
+	Collection string
+	ID         string
+	Sentinel   error
+	Err        error
+}
+
+func (e *CorruptDocumentError) Error() string {
+	return fmt.Sprintf("%s: corrupt %s document %s: %s", e.Sentinel, e.Collection, e.ID, e.Err)
+}
+
+func (e *CorruptDocumentError) Is(target error) bool { return target == e.Sentinel }
+func (e *CorruptDocumentError) Unwrap() error        { return e.Err }
+
+func newCorruptTenantError(tenantID string, err error) *CorruptDocumentError {
+	return &CorruptDocumentError{Collection: "tenant", ID: tenantID, Sentinel: restql.ErrMappingsNotFoundInDatabase, Err: err}
+}
+
+func newCorruptQueryError(namespace string, name string, err error) *CorruptDocumentError {
+	return &CorruptDocumentError{Collection: "query", ID: namespace + "/" + name, Sentinel: restql.ErrQueryNotFoundInDatabase, Err: err}
+}
+
+// WriteConflictError is returned when a write collides with a concurrent one,
+// such as two upserts of the same document. It is safe to try the write again.
+// It matches restql.ErrDatabaseCommunicationFailed.
+type WriteConflictError struct {
+	Operation string
+	Err       error
+}
+
+func (e *WriteConflictError) Error() string {
+	return fmt.Sprintf("%s: %s conflicted with a concurrent write: %s", restql.ErrDatabaseCommunicationFailed, e.Operation, e.Err)
+}
+
+func (e *WriteConflictError) Is(target error) bool {
+	return target == restql.ErrDatabaseCommunicationFailed
+}
+func (e *WriteConflictError) Unwrap() error { return e.Err }
+
+// RevisionConflictError is returned when a query revision is created expecting
+// the query to have a number of revisions it no longer has, meaning that it
+// was changed since the caller read it. Actual is the current number of revisions.
+type RevisionConflictError struct {
+	Namespace string
+	Name      string
+	Expected  int
+	Actual    int
+}
+
+func (e *RevisionConflictError) Error() string {
+	return fmt.Sprintf("query %s/%s has %d revisions, expected %d", e.Namespace, e.Name, e.Actual, e.Expected)
+}
+
+// isAuthenticationError reports whether the server rejected the credentials,
+// either on the connection handshake or when running the command.
+func isAuthenticationError(err error) bool {
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.Code == errCodeAuthenticationFailed || cmdErr.Code == errCodeUnauthorized
+	}
+
+	var connErr topology.ConnectionError
+	if errors.As(err, &connErr) {
+		_, isAuth := connErr.Wrapped.(*auth.Error)
+		return isAuth
+	}
+
+	return false
+}
+
+func isWriteConflict(err error) bool {
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.Code == errCodeWriteConflict
+	}
+
+	var writeErr mongo.WriteException
+	if errors.As(err, &writeErr) {
+		for _, we := range writeErr.WriteErrors {
+			if we.Code == errCodeDuplicateKey || we.Code == errCodeWriteConflict {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func isDuplicateKey(err error) bool {
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.Code == errCodeDuplicateKey
+	}
+
+	var writeErr mongo.WriteException
+	if errors.As(err, &writeErr) {
+		for _, we := range writeErr.WriteErrors {
+			if we.Code == errCodeDuplicateKey {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,192 @@
+package restql_mongodb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// indexSpec describes an index the plugin relies on.
+type indexSpec struct {
+	collection string
+	name       string
+	keys       bson.D
+	unique     bool
+}
+
+func (is indexSpec) String() string {
+	return fmt.Sprintf("%s.%s", is.collection, is.name)
+}
+
+func (is indexSpec) model() mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys:    is.keys,
+		Options: options.Index().SetName(is.name).SetUnique(is.unique),
+	}
+}
+
+// IndexError lists the required indexes that are missing or conflict
+// with an existing index.
+type IndexError struct {
+	Problems []string
+}
+
+func (ie *IndexError) Error() string {
+	return fmt.Sprintf("database indexes not ready: %s", strings.Join(ie.Problems, "; "))
+}
+
+// requiredIndexes returns the indexes that keep queries unique and serve the
+// finders. The mappings are fetched by _id, which is always indexed.
+func (md *mongoDatabase) requiredIndexes() []indexSpec {
+	specs := []indexSpec{
+		{
+			collection: "query",
+			name:       "namespace_name_unique",
+			keys:       bson.D{{Key: "namespace", Value: 1}, {Key: "name", Value: 1}},
+			unique:     true,
+		},
+	}
+
+	if md.separateRevisions() {
+		specs = append(specs, md.revisionsIndex())
+	}
+
+	return specs
+}
+
+func (md *mongoDatabase) revisionsIndex() indexSpec {
+	return indexSpec{
+		collection: md.config.RevisionsCollection,
+		name:       "namespace_name_revision_unique",
+		keys:       bson.D{{Key: "namespace", Value: 1}, {Key: "name", Value: 1}, {Key: "revision", Value: 1}},
+		unique:     true,
+	}
+}
+
+// verifyIndexes checks the required indexes, creating the missing ones when
+// configured to. Every problem is logged as a warning and returned in an *IndexError.
+func (md *mongoDatabase) verifyIndexes(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(md.config.ConnectionTimeout))
+	defer cancel()
+
+	var problems []string
+	for _, spec := range md.requiredIndexes() {
+		problem, err := md.verifyIndex(ctx, spec, md.config.Indexes.Ensure)
+		if err != nil {
+			return err
+		}
+		if problem != "" {
+			md.logger.Warn("database index problem", "index", spec.String(), "problem", problem)
+			problems = append(problems, fmt.Sprintf("%s: %s", spec, problem))
+		}
+	}
+
+	if len(problems) > 0 {
+		return &IndexError{Problems: problems}
+	}
+
+	md.logger.Info("database indexes verified")
+
+	return nil
+}
+
+// ensureIndex creates the index, failing if it cannot be created.
+func (md *mongoDatabase) ensureIndex(ctx context.Context, spec indexSpec) error {
+	problem, err := md.verifyIndex(ctx, spec, true)
+	if err != nil {
+		return err
+	}
+	if problem != "" {
+		return &IndexError{Problems: []string{fmt.Sprintf("%s: %s", spec, problem)}}
+	}
+
+	return nil
+}
+
+// verifyIndex returns a description of the problem found with the index,
+// or an error if the indexes could not be listed.
+func (md *mongoDatabase) verifyIndex(ctx context.Context, spec indexSpec, create bool) (string, error) {
+	collection, release, err := md.collection(spec.collection)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	cursor, err := collection.Indexes().List(ctx)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to list indexes of %s", spec.collection)
+	}
+
+	var existing []struct {
+		Name   string `bson:"name"`
+		Key    bson.D `bson:"key"`
+		Unique bool   `bson:"unique"`
+	}
+	err = cursor.All(ctx, &existing)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to list indexes of %s", spec.collection)
+	}
+
+	for _, index := range existing {
+		sameKeys := sameIndexKeys(index.Key, spec.keys)
+		switch {
+		case sameKeys && index.Unique == spec.unique:
+			return "", nil
+		case sameKeys:
+			return fmt.Sprintf("index %s has the same keys but unique is %t", index.Name, index.Unique), nil
+		case index.Name == spec.name:
+			return fmt.Sprintf("index %s exists with different keys", index.Name), nil
+		}
+	}
+
+	if !create {
+		return "index missing", nil
+	}
+
+	_, err = collection.Indexes().CreateOne(ctx, spec.model())
+	if isDuplicateKey(err) {
+		return "index could not be created because of duplicate documents", nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create index %s", spec)
+	}
+
+	md.logger.Info("database index created", "index", spec.String())
+
+	return "", nil
+}
+
+func sameIndexKeys(a bson.D, b bson.D) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Key != b[i].Key || fmt.Sprint(indexDirection(a[i].Value)) != fmt.Sprint(indexDirection(b[i].Value)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// indexDirection normalizes the numeric key directions,
+// which the server may return as any numeric type.
+func indexDirection(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	default:
+		return v
+	}
+}
@@ -3,10 +3,9 @@ package restql_mongodb
 import (
 	"context"
 	"fmt"
-	"go.mongodb.org/mongo-driver/bson/primitive"
-	"math"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -38,83 +37,248 @@ type tenant struct {
 }
 
 type revision struct {
-	Text       string
+	Text     string
 	Archived bool
+	// NormalizedHash is only stored with the whitespace deduplication,
+	// the exact one compares the sha256 of the metadata.
+	NormalizedHash string `bson:"normalizedHash,omitempty"`
+
+	RevisionMetadata `bson:",inline"`
 }
 
 type query struct {
 	Name      string
 	Namespace string
 	Size      int
-	Archived bool
+	Archived  bool
 	Revisions []revision
 }
 
 type mongoDatabase struct {
 	logger          restql.Logger
-	client          *mongo.Client
+	config          Config
+	conn            *connection
 	mappingsTimeout time.Duration
 	queryTimeout    time.Duration
+	writeTimeout    time.Duration
 	databaseName    string
+	cache           *databaseCache
+	snapshot        *snapshotStore
+	certificates    *certificateReloader
+	metrics         *operationMetrics
+	retry           retryPolicy
+	breaker         *circuitBreaker
+	stopBackground  context.CancelFunc
+	workers         sync.WaitGroup
+	closeOnce       sync.Once
+	closeErr        error
+}
+
+// Plugin is the database plugin created by NewMongoDatabase. Besides the
+// restQL finders, it exposes the operations restQL itself does not call.
+type Plugin interface {
+	restql.DatabasePlugin
+
+	// Ready reports whether the database connection has been established.
+	Ready() bool
+	// HealthCheck pings the database.
+	HealthCheck(ctx context.Context) error
+	// Close stops the background workers and disconnects the client.
+	Close(ctx context.Context) error
+	// OperationStats returns the statistics of every database operation keyed by its name.
+	OperationStats() map[string]OperationStats
+
+	// CreateRevision creates a query revision, optionally with compare-and-swap semantics.
+	CreateRevision(ctx context.Context, namespace string, queryName string, content string, opts RevisionOptions) (int, error)
+	// FindQueryRevision and FindQueryRevisions fetch revisions with their metadata,
+	// always reading the database, skipping the cache and the snapshot.
+	FindQueryRevision(ctx context.Context, namespace string, name string, revision int) (QueryRevision, error)
+	FindQueryRevisions(ctx context.Context, namespace string, queryName string, archived bool) ([]QueryRevision, error)
+
+	// MigrateRevisions moves the embedded revisions to the revisions collection.
+	MigrateRevisions(ctx context.Context) (MigrationReport, error)
+	// MergeDuplicateQueries merges the queries saved more than once under the same name.
+	MergeDuplicateQueries(ctx context.Context, opts MergeOptions) (DuplicatesReport, error)
+	// CheckConsistency reports, and optionally repairs, inconsistent queries and tenants.
+	CheckConsistency(ctx context.Context, repair bool) (ConsistencyReport, error)
 }
 
+// NewMongoDatabase creates the plugin from the configuration in the environment.
+// The returned restql.DatabasePlugin is a Plugin.
 func NewMongoDatabase(log restql.Logger) (restql.DatabasePlugin, error) {
-	connectionString := os.Getenv("RESTQL_DATABASE_CONNECTION_STRING")
-	if connectionString == "" {
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Error("failed to load database configuration", err)
+		return nil, err
+	}
+
+	if cfg.ConnectionString == "" && cfg.Credentials.ConnectionStringFile == "" {
 		log.Info("mongo connection string not detected")
 		return nil, nil
 	}
 
-	envTimeout := os.Getenv("RESTQL_DATABASE_CONNECTION_TIMEOUT")
-	timeout, err := time.ParseDuration(envTimeout)
+	return NewMongoDatabaseWithConfig(log, cfg)
+}
+
+// NewMongoDatabaseWithConfig creates the plugin from an explicit configuration
+// instead of reading it from the environment.
+func NewMongoDatabaseWithConfig(log restql.Logger, cfg Config) (Plugin, error) {
+	err := cfg.Validate()
 	if err != nil {
-		log.Error("failed to parse connection timeout", err)
+		log.Error("invalid database configuration", err)
 		return nil, err
 	}
 
-	log.Info("starting database connection", "timeout", timeout.String())
+	var snapshot *snapshotStore
+	if cfg.Snapshot.Path != "" {
+		snapshot, err = loadSnapshot(log, cfg.Snapshot.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+	var cache *databaseCache
+	if cfg.Cache.MaxEntries > 0 {
+		log.Info("database cache enabled", "maxEntries", cfg.Cache.MaxEntries, "mappingsTTL", time.Duration(cfg.Cache.MappingsTTL).String(), "queryTTL", time.Duration(cfg.Cache.QueryTTL).String(), "latestQueryTTL", time.Duration(cfg.Cache.LatestQueryTTL).String())
+		cache = newDatabaseCache(cfg.Cache.MaxEntries, time.Duration(cfg.Cache.MappingsTTL), time.Duration(cfg.Cache.QueryTTL), time.Duration(cfg.Cache.LatestQueryTTL))
+	}
+
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+
+	md := &mongoDatabase{
+		logger:          log,
+		config:          cfg,
+		conn:            &connection{},
+		mappingsTimeout: time.Duration(cfg.MappingsReadTimeout),
+		queryTimeout:    time.Duration(cfg.QueryReadTimeout),
+		writeTimeout:    time.Duration(cfg.WriteTimeout),
+		databaseName:    cfg.DatabaseName,
+		cache:           cache,
+		snapshot:        snapshot,
+		metrics:         newOperationMetrics(),
+		retry:           newRetryPolicy(cfg.Retry),
+		breaker:         newCircuitBreaker(log, cfg.CircuitBreaker),
+		stopBackground:  stopBackground,
+	}
+
+	if cfg.TLS.CertificateFile != "" {
+		md.certificates, err = newCertificateReloader(log, cfg.TLS.CertificateFile, cfg.TLS.KeyFile)
+		if err != nil {
+			log.Error("failed to load database client certificate", err)
+			stopBackground()
+			return nil, err
+		}
+	}
+
+	if cfg.HandleSignals {
+		md.runWorker(backgroundCtx, md.handleSignals)
+	}
+
+	if snapshot != nil {
+		md.runWorker(backgroundCtx, func(ctx context.Context) {
+			snapshot.RunFlusher(ctx, log, time.Duration(cfg.Snapshot.FlushInterval))
+		})
+	}
+
+	// only used when the strict indexes are disabled, so it never fails
+	onConnected := func(ctx context.Context) {
+		md.verifyIndexesOnStartup(ctx)
+		md.startWorkers(ctx)
+	}
 
-	client, err := mongo.Connect(ctx,
-		options.Client().ApplyURI(connectionString),
-		options.Client().SetConnectTimeout(timeout),
-	)
+	timeout := time.Duration(cfg.ConnectionTimeout)
+	if cfg.LazyConnect {
+		log.Info("starting database connection in background", "timeout", timeout.String())
+		md.runWorker(backgroundCtx, func(ctx context.Context) {
+			md.connectInBackground(ctx, onConnected)
+		})
+		return md, nil
+	}
+
+	resolved, err := cfg.resolveCredentials()
 	if err != nil {
+		log.Error("failed to read database credential files", err)
+		stopBackground()
 		return nil, err
 	}
 
-	err = client.Ping(ctx, nil)
+	// invalid options fail the startup even with a snapshot, retrying would not fix them
+	_, err = md.clientOptions(resolved)
 	if err != nil {
+		log.Error("failed to build database client options", err)
+		stopBackground()
+		return nil, err
+	}
+
+	log.Info("starting database connection", "timeout", timeout.String())
+
+	client, err := md.connect(backgroundCtx, resolved)
+	switch {
+	case err != nil && snapshot.Empty():
+		stopBackground()
 		return nil, err
+	case err != nil:
+		log.Warn("database unreachable, starting in degraded mode from snapshot", "error", err.Error())
+		md.runWorker(backgroundCtx, func(ctx context.Context) {
+			md.connectInBackground(ctx, onConnected)
+		})
+		return md, nil
 	}
 
-	log.Info("database connection established", "url", connectionString)
+	log.Info("database connection established", "url", redactConnectionString(resolved.ConnectionString))
 
-	envMappingTimeout := os.Getenv("RESTQL_DATABASE_MAPPINGS_READ_TIMEOUT")
-	mappingTimeout, err := time.ParseDuration(envMappingTimeout)
+	md.conn.swap(client, resolved.credentials())
+
+	err = md.verifyIndexesOnStartup(backgroundCtx)
 	if err != nil {
-		log.Error("failed to parse mappings read timeout", err)
+		md.Close(context.Background())
 		return nil, err
 	}
 
-	envQueryTimeout := os.Getenv("RESTQL_DATABASE_QUERY_READ_TIMEOUT")
-	queryTimeout, err := time.ParseDuration(envQueryTimeout)
+	md.startWorkers(backgroundCtx)
+
+	return md, nil
+}
+
+// verifyIndexesOnStartup checks the required indexes, only returning an
+// error when some are missing and the strict mode is enabled.
+func (md *mongoDatabase) verifyIndexesOnStartup(ctx context.Context) error {
+	err := md.verifyIndexes(ctx)
+
+	var indexErr *IndexError
+	switch {
+	case errors.As(err, &indexErr) && md.config.Indexes.Strict:
+		md.logger.Error("refusing to start without the required database indexes", err)
+		return err
+	case err != nil && indexErr == nil:
+		md.logger.Warn("failed to verify database indexes", "error", err.Error())
+	}
+
+	return nil
+}
+
+// startWorkers starts the background workers that depend on the database connection.
+func (md *mongoDatabase) startWorkers(ctx context.Context) {
+	if md.cache != nil && md.config.Cache.WatchEnabled {
+		md.startCacheWatchers(ctx)
+	}
+
+	if md.config.watchesFiles() {
+		md.runWorker(ctx, md.watchCredentials)
+	}
+}
+
+func loadSnapshot(log restql.Logger, path string) (*snapshotStore, error) {
+	snapshot := newSnapshotStore(path)
+	err := snapshot.Load()
 	if err != nil {
-		log.Error("failed to parse query read timeout", err)
+		log.Error("failed to load database snapshot", err, "path", path)
 		return nil, err
 	}
 
-	databaseName := os.Getenv("RESTQL_DATABASE_NAME")
+	log.Info("database snapshot enabled", "path", path)
 
-	return &mongoDatabase{
-		logger:          log,
-		client:          client,
-		mappingsTimeout: mappingTimeout,
-		queryTimeout:    queryTimeout,
-		databaseName:    databaseName,
-	}, nil
+	return snapshot, nil
 }
 
 func (md *mongoDatabase) Name() string {
@@ -123,40 +287,46 @@ func (md *mongoDatabase) Name() string {
 
 func (md *mongoDatabase) FindMappingsForTenant(ctx context.Context, tenantId string) ([]restql.Mapping, error) {
 	log := restql.GetLogger(ctx)
-	mappingsTimeout := md.mappingsTimeout
 
-	var cancel context.CancelFunc
-	if mappingsTimeout > 0 {
-		ctx, cancel = context.WithTimeout(ctx, mappingsTimeout)
-		defer cancel()
+	if mappings, found := md.cache.getMappings(tenantId); found {
+		log.Debug("mappings fetched from cache", "tenant", tenantId)
+		return parseMappings(log, mappings), nil
 	}
-	log.Debug("mappings timeout defined", "timeout", mappingsTimeout)
 
-	maxTime := parseMaxTime(mappingsTimeout)
-
-	var t tenant
-
-	collection := md.client.Database(md.databaseName).Collection("tenant")
-	opt := options.FindOne().SetMaxTime(maxTime)
-	singleResult := collection.FindOne(ctx, bson.M{"_id": tenantId}, opt)
-	err := singleResult.Err()
+	var raw bson.Raw
+	err := md.run(ctx, md.read("find_mappings", "tenant", md.mappingsTimeout), func(ctx context.Context, collection *mongo.Collection, maxTime time.Duration) error {
+		var err error
+		opt := options.FindOne().
+			SetMaxTime(maxTime).
+			SetProjection(bson.M{"mappings": 1})
+		raw, err = collection.FindOne(ctx, bson.M{"_id": tenantId}, opt).DecodeBytes()
+		return err
+	})
 	switch {
 	case err == mongo.ErrNoDocuments:
 		log.Error("mappings not found in database", err, "tenant", tenantId)
 		return nil, fmt.Errorf("%w: tenant %s", restql.ErrMappingsNotFoundInDatabase, tenantId)
 	case err != nil:
 		log.Error("database communication failed when fetching mappings", err, "tenant", tenantId)
-		return nil, fmt.Errorf("%w: %s", restql.ErrDatabaseCommunicationFailed, err)
+		return md.mappingsFallback(log, tenantId, err)
 	}
 
-	err = singleResult.Decode(&t)
+	var t tenant
+	err = bson.Unmarshal(raw, &t)
 	if err != nil {
 		log.Error("failed to decode mappings from database", err, "tenant", tenantId)
-		return nil, fmt.Errorf("%w: %s", restql.ErrMappingsNotFoundInDatabase, err)
+		return nil, newCorruptTenantError(tenantId, err)
 	}
 
+	md.cache.setMappings(tenantId, t.Mappings)
+	md.snapshot.setMappings(tenantId, t.Mappings)
+
+	return parseMappings(log, t.Mappings), nil
+}
+
+func parseMappings(log restql.Logger, mappings map[string]string) []restql.Mapping {
 	var result []restql.Mapping
-	for resourceName, url := range t.Mappings {
+	for resourceName, url := range mappings {
 		mapping, err := restql.NewMapping(resourceName, url)
 		if err != nil {
 			log.Error("failed to parse resource into mapping", err, "name", resourceName, "url", url)
@@ -166,73 +336,187 @@ func (md *mongoDatabase) FindMappingsForTenant(ctx context.Context, tenantId str
 		result = append(result, mapping)
 	}
 
-	return result, nil
+	return result
+}
+
+func (md *mongoDatabase) FindQuery(ctx context.Context, namespace string, name string, revision int) (restql.SavedQueryRevision, error) {
+	log := restql.GetLogger(ctx)
+
+	if savedQuery, found := md.cache.getQuery(namespace, name, revision); found {
+		log.Debug("query fetched from cache", "namespace", namespace, "name", name, "revision", revision)
+		return savedQuery, nil
+	}
+
+	find := md.findEmbeddedRevision
+	if md.separateRevisions() {
+		find = md.findSeparateRevision
+	}
+
+	found, err := find(ctx, namespace, name, revision)
+	switch {
+	case errors.Is(err, restql.ErrDatabaseCommunicationFailed):
+		return md.queryFallback(log, namespace, name, revision, err)
+	case err != nil:
+		return restql.SavedQueryRevision{}, err
+	}
+
+	savedQuery := found.SavedQueryRevision
+
+	if md.isLatestRevision(revision) {
+		md.cache.setLatestQuery(namespace, name, revision, savedQuery)
+	} else {
+		md.cache.setQuery(namespace, name, revision, savedQuery)
+	}
+	md.snapshot.setQuery(namespace, name, revision, savedQuery)
+
+	return savedQuery, nil
 }
 
-func (md mongoDatabase) FindQuery(ctx context.Context, namespace string, name string, revision int) (restql.SavedQueryRevision, error) {
+// findEmbeddedRevision fetches a revision stored inside the query document.
+func (md *mongoDatabase) findEmbeddedRevision(ctx context.Context, namespace string, name string, revision int) (QueryRevision, error) {
 	log := restql.GetLogger(ctx)
 
-	queryTimeout := md.queryTimeout
-	if queryTimeout > 0 {
-		ctx, _ = context.WithTimeout(ctx, queryTimeout)
+	number := revision
+	if md.isLatestRevision(revision) {
+		var err error
+		number, err = md.findLatestRevision(ctx, namespace, name)
+		var corruptErr *CorruptDocumentError
+		switch {
+		case err == mongo.ErrNoDocuments:
+			log.Error("query not found in database", err, "namespace", namespace, "name", name, "revision", revision)
+			return QueryRevision{}, restql.ErrQueryNotFoundInDatabase
+		case errors.As(err, &corruptErr):
+			log.Error("corrupt query document", err, "namespace", namespace, "name", name, "revision", revision)
+			return QueryRevision{}, err
+		case err != nil:
+			log.Error("database communication failed when fetching query", err, "namespace", namespace, "name", name, "revision", revision)
+			return QueryRevision{}, err
+		}
+		log.Debug("latest revision resolved", "namespace", namespace, "name", name, "revision", number)
 	}
-	log.Debug("query timeout defined", "timeout", queryTimeout)
 
-	maxTime := parseMaxTime(queryTimeout)
+	if number < 1 {
+		err := errors.Errorf("invalid revision for query %s/%s: given revision %d", namespace, name, revision)
+
+		log.Error("revision not found", err, "namespace", namespace, "name", name, "revision", revision)
+		return QueryRevision{}, fmt.Errorf("%w: %s", restql.ErrQueryNotFoundInDatabase, err)
+	}
 
-	collection := md.client.Database(md.databaseName).Collection("query")
-	opt := options.FindOne().SetMaxTime(maxTime)
-	singleResult := collection.FindOne(ctx, bson.M{"name": name, "namespace": namespace}, opt)
-	err := singleResult.Err()
+	var raw bson.Raw
+	err := md.run(ctx, md.read("find_query", "query", md.queryTimeout), func(ctx context.Context, collection *mongo.Collection, maxTime time.Duration) error {
+		var err error
+		opt := options.FindOne().
+			SetMaxTime(maxTime).
+			SetProjection(bson.M{"size": 1, "revisions": bson.M{"$slice": bson.A{number - 1, 1}}})
+		raw, err = collection.FindOne(ctx, bson.M{"name": name, "namespace": namespace}, opt).DecodeBytes()
+		return err
+	})
 	switch {
 	case err == mongo.ErrNoDocuments:
 		log.Error("query not found in database", err, "namespace", namespace, "name", name, "revision", revision)
-		return restql.SavedQueryRevision{}, restql.ErrQueryNotFoundInDatabase
+		return QueryRevision{}, restql.ErrQueryNotFoundInDatabase
 	case err != nil:
 		log.Error("database communication failed when fetching query", err, "namespace", namespace, "name", name, "revision", revision)
-		return restql.SavedQueryRevision{}, fmt.Errorf("%w: %s", restql.ErrDatabaseCommunicationFailed, err)
+		return QueryRevision{}, err
 	}
 
 	var q query
-	err = singleResult.Decode(&q)
+	err = bson.Unmarshal(raw, &q)
 	if err != nil {
 		log.Error("failed to decode query from database", err, "namespace", namespace, "name", name, "revision", revision)
-		return restql.SavedQueryRevision{}, fmt.Errorf("%w: %s", restql.ErrQueryNotFoundInDatabase, err)
+		return QueryRevision{}, newCorruptQueryError(namespace, name, err)
 	}
 
-	if q.Size < revision || revision < 0 {
+	// Only the requested revision is fetched, so the size can only be
+	// checked against whether the revision is actually stored.
+	stored := len(q.Revisions) == 1
+	if stored != (number <= q.Size) {
+		err := errors.Errorf("size %d does not match the stored revisions, revision %d stored: %t", q.Size, number, stored)
+
+		log.Error("corrupt query document", err, "namespace", namespace, "name", name, "revision", revision)
+		return QueryRevision{}, newCorruptQueryError(namespace, name, err)
+	}
+
+	if !stored {
 		err := errors.Errorf("invalid revision for query %s/%s: major revision %d, given revision %d", namespace, name, q.Size, revision)
 
 		log.Error("revision not found", err, "namespace", namespace, "name", name, "revision", revision)
-		return restql.SavedQueryRevision{}, fmt.Errorf("%w: %s", restql.ErrQueryNotFoundInDatabase, err)
+		return QueryRevision{}, fmt.Errorf("%w: %s", restql.ErrQueryNotFoundInDatabase, err)
 	}
 
-	r := q.Revisions[revision-1]
+	r := q.Revisions[0]
 
-	return restql.SavedQueryRevision{Name: name, Text: r.Text, Revision: revision, Archived: r.Archived}, nil
+	return QueryRevision{
+		SavedQueryRevision: restql.SavedQueryRevision{Name: name, Text: r.Text, Revision: number, Archived: r.Archived},
+		RevisionMetadata:   r.RevisionMetadata,
+	}, nil
 }
 
-func (md *mongoDatabase) FindAllNamespaces(ctx context.Context) ([]string, error) {
-	log := restql.GetLogger(ctx)
+// findLatestRevision returns the number of the latest non-archived revision of
+// a query, reading only the archiving flags of its revisions.
+func (md *mongoDatabase) findLatestRevision(ctx context.Context, namespace string, name string) (int, error) {
+	var raw bson.Raw
+	err := md.run(ctx, md.read("find_latest_revision", "query", md.queryTimeout), func(ctx context.Context, collection *mongo.Collection, maxTime time.Duration) error {
+		var err error
+		opt := options.FindOne().
+			SetMaxTime(maxTime).
+			SetProjection(bson.M{"size": 1, "revisions.archived": 1})
+		raw, err = collection.FindOne(ctx, bson.M{"name": name, "namespace": namespace}, opt).DecodeBytes()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var q query
+	err = bson.Unmarshal(raw, &q)
+	if err != nil {
+		return 0, newCorruptQueryError(namespace, name, err)
+	}
+
+	if q.Size != len(q.Revisions) {
+		err := errors.Errorf("size %d does not match the %d stored revisions", q.Size, len(q.Revisions))
+		return 0, newCorruptQueryError(namespace, name, err)
+	}
+
+	return latestRevision(q.Revisions), nil
+}
 
-	queryTimeout := md.queryTimeout
-	if queryTimeout > 0 {
-		ctx, _ = context.WithTimeout(ctx, queryTimeout)
+// isLatestRevision reports whether the requested revision
+// stands for the latest one, either 0 or the configured sentinel.
+func (md *mongoDatabase) isLatestRevision(revision int) bool {
+	return revision == 0 || revision == md.config.LatestRevision
+}
+
+// latestRevision returns the number of the last revision that is not
+// archived, or zero when every revision is archived.
+func latestRevision(revisions []revision) int {
+	for i := len(revisions) - 1; i >= 0; i-- {
+		if !revisions[i].Archived {
+			return i + 1
+		}
 	}
-	log.Debug("query timeout defined", "timeout", queryTimeout)
 
-	maxTime := parseMaxTime(queryTimeout)
+	return 0
+}
+
+func (md *mongoDatabase) FindAllNamespaces(ctx context.Context) ([]string, error) {
+	log := restql.GetLogger(ctx)
 
-	collection := md.client.Database(md.databaseName).Collection("query")
-	opt := options.Distinct().SetMaxTime(maxTime)
-	dbResult, err := collection.Distinct(ctx, "namespace", bson.M{}, opt)
+	var dbResult []interface{}
+	err := md.run(ctx, md.read("find_all_namespaces", "query", md.queryTimeout), func(ctx context.Context, collection *mongo.Collection, maxTime time.Duration) error {
+		var err error
+		opt := options.Distinct().SetMaxTime(maxTime)
+		dbResult, err = collection.Distinct(ctx, "namespace", bson.M{}, opt)
+		return err
+	})
 	switch {
 	case err == mongo.ErrNoDocuments:
 		log.Error("no namespace found in database", err)
 		return nil, nil
 	case err != nil:
 		log.Error("database communication failed when fetching query", err)
-		return nil, fmt.Errorf("%w: %s", restql.ErrDatabaseCommunicationFailed, err)
+		return nil, err
 	}
 
 	namespace := make([]string, len(dbResult))
@@ -252,42 +536,52 @@ func (md *mongoDatabase) FindAllNamespaces(ctx context.Context) ([]string, error
 func (md *mongoDatabase) FindQueriesForNamespace(ctx context.Context, namespace string, archived bool) ([]restql.SavedQuery, error) {
 	log := restql.GetLogger(ctx)
 
-	queryTimeout := md.queryTimeout
-	if queryTimeout > 0 {
-		ctx, _ = context.WithTimeout(ctx, queryTimeout)
+	if md.separateRevisions() {
+		return md.findSeparateQueries(ctx, namespace, archived)
 	}
-	log.Debug("query timeout defined", "timeout", queryTimeout)
-
-	maxTime := parseMaxTime(queryTimeout)
 
-	collection := md.client.Database(md.databaseName).Collection("query")
-	opt := options.Find().SetMaxTime(maxTime)
 	filter := bson.M{
 		"namespace": namespace,
-		"$or": bson.A{
-			bson.M{"archived": bson.M{"$ne": !archived}},
-			bson.M{"revisions": bson.M{"$elemMatch": bson.M{"archived": archived}}},
-		},
+		"revisions": bson.M{"$elemMatch": bson.M{"archived": archivedFilter(archived)}},
 	}
-	cursor, err := collection.Find(ctx, filter, opt)
+
+	var documents []bson.Raw
+	err := md.run(ctx, md.read("find_queries_for_namespace", "query", md.queryTimeout), func(ctx context.Context, collection *mongo.Collection, maxTime time.Duration) error {
+		opt := options.Find().
+			SetMaxTime(maxTime).
+			SetProjection(bson.M{"_id": 0, "namespace": 1, "name": 1, "archived": 1, "revisions": 1})
+		cursor, err := collection.Find(ctx, filter, opt)
+		if err != nil {
+			return err
+		}
+		err = cursor.All(ctx, &documents)
+		if err != nil || len(documents) > 0 {
+			return err
+		}
+		return namespaceExists(ctx, collection, namespace, maxTime)
+	})
 	switch {
 	case err == mongo.ErrNoDocuments:
 		log.Error("namespace not found in database", err, "namespace", namespace)
-		return nil, restql.ErrNamespaceNotFound
+		return nil, fmt.Errorf("%w: %s", restql.ErrNamespaceNotFound, namespace)
 	case err != nil:
 		log.Error("database communication failed when fetching query", err, "namespace", namespace)
-		return nil, fmt.Errorf("%w: %s", restql.ErrDatabaseCommunicationFailed, err)
+		return nil, err
 	}
 
-	var queries []query
-	err = cursor.All(ctx, &queries)
-	if err != nil {
-		return nil, err
+	queries := make([]query, len(documents))
+	for i, document := range documents {
+		err = bson.Unmarshal(document, &queries[i])
+		if err != nil {
+			name, _ := document.Lookup("name").StringValueOK()
+			log.Error("failed to decode query from database", err, "namespace", namespace, "name", name)
+			return nil, newCorruptQueryError(namespace, name, err)
+		}
 	}
 
 	log.Debug("raw namespaced queries from db", "value", queries)
-	queriesForNamespace := make([]restql.SavedQuery, len(queries))
-	for i, q := range queries {
+	queriesForNamespace := make([]restql.SavedQuery, 0, len(queries))
+	for _, q := range queries {
 		savedQuery := restql.SavedQuery{
 			Namespace: q.Namespace,
 			Name:      q.Name,
@@ -296,7 +590,7 @@ func (md *mongoDatabase) FindQueriesForNamespace(ctx context.Context, namespace
 		}
 
 		for i, r := range q.Revisions {
-			if r.Archived != archived  {
+			if r.Archived != archived {
 				continue
 			}
 
@@ -309,7 +603,9 @@ func (md *mongoDatabase) FindQueriesForNamespace(ctx context.Context, namespace
 			savedQuery.Revisions = append(savedQuery.Revisions, queryRevision)
 		}
 
-		queriesForNamespace[i] = savedQuery
+		if len(savedQuery.Revisions) > 0 {
+			queriesForNamespace = append(queriesForNamespace, savedQuery)
+		}
 	}
 
 	log.Debug("namespace queries fetched from database", "queries", queriesForNamespace, "namespace", namespace)
@@ -318,39 +614,49 @@ func (md *mongoDatabase) FindQueriesForNamespace(ctx context.Context, namespace
 }
 
 func (md *mongoDatabase) FindQueryWithAllRevisions(ctx context.Context, namespace string, queryName string, archived bool) (restql.SavedQuery, error) {
-	log := restql.GetLogger(ctx)
-
-	collection := md.client.Database(md.databaseName).Collection("query")
+	revisions, err := md.FindQueryRevisions(ctx, namespace, queryName, archived)
+	if err != nil {
+		return restql.SavedQuery{}, err
+	}
 
-	queryTimeout := md.queryTimeout
-	if queryTimeout > 0 {
-		ctx, _ = context.WithTimeout(ctx, queryTimeout)
+	queryRevisions := make([]restql.SavedQueryRevision, len(revisions))
+	for i, r := range revisions {
+		queryRevisions[i] = r.SavedQueryRevision
 	}
-	log.Debug("query timeout defined", "timeout", queryTimeout)
 
-	maxTime := parseMaxTime(queryTimeout)
-	opt := options.FindOne().SetMaxTime(maxTime)
+	return restql.SavedQuery{Namespace: namespace, Name: queryName, Revisions: queryRevisions}, nil
+}
+
+func (md *mongoDatabase) findEmbeddedQueryRevisions(ctx context.Context, namespace string, queryName string, archived bool) ([]QueryRevision, error) {
+	log := restql.GetLogger(ctx)
 
-	singleResult := collection.FindOne(ctx, bson.M{"namespace": namespace, "name": queryName}, opt)
-	err := singleResult.Err()
+	var raw bson.Raw
+	err := md.run(ctx, md.read("find_query_with_all_revisions", "query", md.queryTimeout), func(ctx context.Context, collection *mongo.Collection, maxTime time.Duration) error {
+		var err error
+		opt := options.FindOne().
+			SetMaxTime(maxTime).
+			SetProjection(bson.M{"_id": 0, "name": 1, "revisions": 1})
+		raw, err = collection.FindOne(ctx, bson.M{"namespace": namespace, "name": queryName}, opt).DecodeBytes()
+		return err
+	})
 	switch {
 	case err == mongo.ErrNoDocuments:
 		log.Error("query not found in database", err, "namespace", namespace, "name", queryName)
-		return restql.SavedQuery{}, restql.ErrQueryNotFoundInDatabase
+		return nil, restql.ErrQueryNotFoundInDatabase
 	case err != nil:
 		log.Error("database communication failed when fetching query", err, "namespace", namespace, "name", queryName)
-		return restql.SavedQuery{}, fmt.Errorf("%w: %s", restql.ErrDatabaseCommunicationFailed, err)
+		return nil, err
 	}
 
 	var q query
 
-	err = singleResult.Decode(&q)
+	err = bson.Unmarshal(raw, &q)
 	if err != nil {
 		log.Error("failed to decode query from database", err, "namespace", namespace, "name", queryName)
-		return restql.SavedQuery{}, fmt.Errorf("%w: %s", restql.ErrQueryNotFoundInDatabase, err)
+		return nil, newCorruptQueryError(namespace, queryName, err)
 	}
 
-	queryRevisions := []restql.SavedQueryRevision{}
+	queryRevisions := []QueryRevision{}
 	for i, r := range q.Revisions {
 		if r.Archived != archived {
 			continue
@@ -362,67 +668,173 @@ func (md *mongoDatabase) FindQueryWithAllRevisions(ctx context.Context, namespac
 			Archived: r.Archived,
 			Revision: i + 1,
 		}
-		queryRevisions = append(queryRevisions, queryRevision)
+		queryRevisions = append(queryRevisions, QueryRevision{SavedQueryRevision: queryRevision, RevisionMetadata: r.RevisionMetadata})
 	}
 
 	log.Debug("query revisions fetched from database", "revisions", queryRevisions, "namespace", namespace, "name", queryName)
 
-	savedQuery := restql.SavedQuery{
-		Namespace: namespace,
-		Name:      queryName,
-		Revisions: queryRevisions,
-	}
-
-	return savedQuery, nil
+	return queryRevisions, nil
 }
 
 func (md *mongoDatabase) CreateQueryRevision(ctx context.Context, namespace string, queryName string, content string) error {
+	_, err := md.CreateRevision(ctx, namespace, queryName, content, RevisionOptions{})
+	return err
+}
+
+// RevisionOptions controls the creation of a query revision.
+type RevisionOptions struct {
+	// ExpectedSize, when set, only creates the revision if the query has
+	// this many revisions, zero meaning that the query must not exist yet.
+	// Otherwise a *RevisionConflictError is returned.
+	ExpectedSize *int
+	// Message is recorded on the revision, describing the change.
+	Message string
+}
+
+// CreateRevision creates a query revision like CreateQueryRevision,
+// returning the number of the new revision. With revision deduplication
+// enabled, a text matching the latest revision creates nothing, returning
+// the number of the latest revision instead.
+func (md *mongoDatabase) CreateRevision(ctx context.Context, namespace string, queryName string, content string, opts RevisionOptions) (int, error) {
 	log := restql.GetLogger(ctx)
 
-	queryTimeout := md.queryTimeout
-	if queryTimeout > 0 {
-		ctx, _ = context.WithTimeout(ctx, queryTimeout)
+	if opts.ExpectedSize != nil && *opts.ExpectedSize < 0 {
+		return 0, errors.Errorf("invalid expected size %d", *opts.ExpectedSize)
+	}
+
+	rev := md.newRevision(ctx, content, opts.Message)
+	if md.config.RevisionDeduplication == "" {
+		return md.createRevision(ctx, namespace, queryName, rev, opts.ExpectedSize)
 	}
-	log.Debug("query timeout defined", "timeout", queryTimeout)
 
-	opts := options.Update().SetUpsert(true)
-	collection := md.client.Database(md.databaseName).Collection("query")
+	for attempt := 1; attempt <= revisionCreateAttempts; attempt++ {
+		size, latest, err := md.findLastRevision(ctx, namespace, queryName)
+		if err != nil {
+			log.Error("database communication failed when fetching the latest query revision", err, "namespace", namespace, "name", queryName)
+			return 0, err
+		}
 
-	rev := revision{Text: content}
-	_, err := collection.UpdateOne(
-		ctx,
-		bson.M{"namespace": namespace, "name": queryName},
-		bson.D{
-			{"$inc", bson.M{"size": 1}},
-			{"$push", bson.M{"revisions": rev}},
-		},
-		opts,
-	)
+		if md.unchangedRevision(size, latest, rev, opts.ExpectedSize) {
+			log.Info("query revision unchanged, not created", "namespace", namespace, "name", queryName, "revision", size)
+			return size, nil
+		}
 
-	return err
+		// creating on top of the revision just compared, which
+		// conflicts if another one is created in between
+		expected := opts.ExpectedSize
+		if expected == nil {
+			expected = &size
+		}
+
+		number, err := md.createRevision(ctx, namespace, queryName, rev, expected)
+		var conflict *RevisionConflictError
+		if opts.ExpectedSize == nil && errors.As(err, &conflict) {
+			continue
+		}
+		return number, err
+	}
+
+	// callers that did not ask for a compare-and-swap never get a conflict,
+	// at worst the revision duplicates one created concurrently
+	log.Warn("query revision kept changing while deduplicating, creating it anyway", "namespace", namespace, "name", queryName)
+	return md.createRevision(ctx, namespace, queryName, rev, nil)
 }
 
-func (md *mongoDatabase) FindAllTenants(ctx context.Context) ([]string, error) {
+func (md *mongoDatabase) createRevision(ctx context.Context, namespace string, queryName string, rev revision, expected *int) (int, error) {
 	log := restql.GetLogger(ctx)
 
-	queryTimeout := md.queryTimeout
-	if queryTimeout > 0 {
-		ctx, _ = context.WithTimeout(ctx, queryTimeout)
+	var number int
+	var conflict bool
+	err := md.run(ctx, md.write("create_query_revision", "query"), func(ctx context.Context, collection *mongo.Collection, _ time.Duration) error {
+		var err error
+		if md.separateRevisions() {
+			number, conflict, err = md.insertSeparateRevision(ctx, collection, namespace, queryName, rev, expected)
+		} else {
+			number, conflict, err = md.incrementSize(ctx, collection, namespace, queryName, rev, expected)
+		}
+		return err
+	})
+
+	md.cache.invalidateQuery(namespace, queryName)
+
+	if err != nil {
+		log.Error("database communication failed when creating query revision", err, "namespace", namespace, "name", queryName)
+		return 0, err
+	}
+
+	if conflict {
+		err := &RevisionConflictError{Namespace: namespace, Name: queryName, Expected: *expected, Actual: number}
+		log.Warn("query revision not created", "namespace", namespace, "name", queryName, "error", err.Error())
+		return 0, err
 	}
-	log.Debug("query timeout defined", "timeout", queryTimeout)
 
-	maxTime := parseMaxTime(queryTimeout)
+	return number, nil
+}
+
+// incrementSize increments the size of the query and pushes the revision,
+// returning the new revision number. On a conflict with the expected size,
+// it returns the current size of the query instead.
+func (md *mongoDatabase) incrementSize(ctx context.Context, collection *mongo.Collection, namespace string, queryName string, rev revision, expected *int) (int, bool, error) {
+	filter := bson.M{"namespace": namespace, "name": queryName}
+	update := bson.M{"$inc": bson.M{"size": 1}, "$push": bson.M{"revisions": rev}}
+	opts := options.FindOneAndUpdate().
+		SetUpsert(true).
+		SetReturnDocument(options.After).
+		SetProjection(bson.M{"size": 1})
+
+	switch {
+	case expected == nil:
+	case *expected == 0:
+		// only insert the query, returning the existing one otherwise
+		update = bson.M{"$setOnInsert": bson.M{"size": 1, "revisions": bson.A{rev}}}
+		opts.SetReturnDocument(options.Before)
+	default:
+		filter["size"] = *expected
+		opts.SetUpsert(false)
+	}
+
+	var q query
+	err := collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&q)
+	switch {
+	case expected == nil && err == nil:
+		return q.Size, false, nil
+	case expected == nil:
+		return 0, false, err
+	case *expected == 0 && err == mongo.ErrNoDocuments:
+		return 1, false, nil
+	case *expected == 0 && err == nil:
+		return q.Size, true, nil
+	case err == nil:
+		return q.Size, false, nil
+	case err != mongo.ErrNoDocuments:
+		return 0, false, err
+	}
+
+	err = collection.FindOne(ctx, bson.M{"namespace": namespace, "name": queryName}, options.FindOne().SetProjection(bson.M{"size": 1})).Decode(&q)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return 0, false, err
+	}
+
+	return q.Size, true, nil
+}
+
+func (md *mongoDatabase) FindAllTenants(ctx context.Context) ([]string, error) {
+	log := restql.GetLogger(ctx)
 
-	collection := md.client.Database(md.databaseName).Collection("tenant")
-	opt := options.Distinct().SetMaxTime(maxTime)
-	dbResult, err := collection.Distinct(ctx, "_id", bson.M{}, opt)
+	var dbResult []interface{}
+	err := md.run(ctx, md.read("find_all_tenants", "tenant", md.queryTimeout), func(ctx context.Context, collection *mongo.Collection, maxTime time.Duration) error {
+		var err error
+		opt := options.Distinct().SetMaxTime(maxTime)
+		dbResult, err = collection.Distinct(ctx, "_id", bson.M{}, opt)
+		return err
+	})
 	switch {
 	case err == mongo.ErrNoDocuments:
 		log.Error("no tenant found in database", err)
 		return nil, nil
 	case err != nil:
 		log.Error("database communication failed when fetching query", err)
-		return nil, fmt.Errorf("%w: %s", restql.ErrDatabaseCommunicationFailed, err)
+		return nil, err
 	}
 
 	tenants := make([]string, len(dbResult))
@@ -442,55 +854,71 @@ func (md *mongoDatabase) FindAllTenants(ctx context.Context) ([]string, error) {
 func (md *mongoDatabase) SetMapping(ctx context.Context, tenantID string, resourceName string, url string) error {
 	log := restql.GetLogger(ctx)
 
-	queryTimeout := md.queryTimeout
-	if queryTimeout > 0 {
-		ctx, _ = context.WithTimeout(ctx, queryTimeout)
-	}
-	log.Debug("query timeout defined", "timeout", queryTimeout)
+	target := fmt.Sprintf("mappings.%s", resourceName)
+	err := md.run(ctx, md.write("set_mapping", "tenant"), func(ctx context.Context, collection *mongo.Collection, _ time.Duration) error {
+		opts := options.Update().SetUpsert(true)
+		_, err := collection.UpdateOne(
+			ctx,
+			bson.M{"_id": tenantID},
+			bson.D{{Key: "$set", Value: bson.M{target: url}}},
+			opts,
+		)
+		return err
+	})
 
-	opts := options.Update().SetUpsert(true)
-	collection := md.client.Database(md.databaseName).Collection("tenant")
+	md.cache.invalidateMappings(tenantID)
 
-	target := fmt.Sprintf("mappings.%s", resourceName)
-	_, err := collection.UpdateOne(
-		ctx,
-		bson.M{"_id": tenantID},
-		bson.D{{"$set", bson.M{target: url}}},
-		opts,
-	)
+	if err != nil {
+		log.Error("database communication failed when setting mapping", err, "tenant", tenantID, "name", resourceName)
+		return err
+	}
 
-	return err
+	return nil
 }
 
 func (md *mongoDatabase) UpdateQueryArchiving(ctx context.Context, namespace string, queryName string, archived bool) error {
 	log := restql.GetLogger(ctx)
 
-	queryTimeout := md.queryTimeout
-	if queryTimeout > 0 {
-		ctx, _ = context.WithTimeout(ctx, queryTimeout)
-	}
-	log.Debug("query timeout defined", "timeout", queryTimeout)
-
-	collection := md.client.Database(md.databaseName).Collection("query")
+	var matched bool
+	var err error
+	if md.separateRevisions() {
+		matched, err = md.updateSeparateQueryArchiving(ctx, namespace, queryName, archived)
+	} else {
+		// the query and all of its revisions share the new state, in a single update.
+		// Only document entries are updated, as the server rejects updating the
+		// fields of null entries, and a document without a revisions array,
+		// which array updates also fail on, only gets the query flag updated.
+		withRevisions := bson.M{"namespace": namespace, "name": queryName, "revisions": bson.M{"$type": "array"}}
+		updates := bson.M{"$set": bson.M{"archived": archived, "revisions.$[r].archived": archived}}
+		opts := options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{bson.M{"r": bson.M{"$type": "object"}}}})
+
+		withoutRevisions := bson.M{"namespace": namespace, "name": queryName, "revisions": bson.M{"$not": bson.M{"$type": "array"}}}
+
+		err = md.run(ctx, md.write("update_query_archiving", "query"), func(ctx context.Context, collection *mongo.Collection, _ time.Duration) error {
+			result, err := collection.UpdateOne(ctx, withRevisions, updates, opts)
+			if err != nil {
+				return err
+			}
+			if result.MatchedCount > 0 {
+				matched = true
+				return nil
+			}
 
-	updates := bson.D{
-		{"$set", bson.M{"archived": archived}},
-	}
-	if archived {
-		updates = append(updates, primitive.E{Key: "$set", Value: bson.M{"revisions.$[].archived": archived}})
+			result, err = collection.UpdateOne(ctx, withoutRevisions, bson.M{"$set": bson.M{"archived": archived}})
+			if err != nil {
+				return err
+			}
+			matched = result.MatchedCount > 0
+			return nil
+		})
 	}
-
-	result, err := collection.UpdateOne(
-		ctx,
-		bson.M{"namespace": namespace, "name": queryName},
-		updates,
-		nil,
-	)
+	md.cache.invalidateQuery(namespace, queryName)
 	if err != nil {
+		log.Error("database communication failed when updating query archiving", err, "namespace", namespace, "name", queryName)
 		return err
 	}
 
-	if result.MatchedCount == 0 {
+	if !matched {
 		return restql.ErrQueryNotFoundInDatabase
 	}
 
@@ -500,43 +928,90 @@ func (md *mongoDatabase) UpdateQueryArchiving(ctx context.Context, namespace str
 func (md *mongoDatabase) UpdateRevisionArchiving(ctx context.Context, namespace string, queryName string, revision int, archived bool) error {
 	log := restql.GetLogger(ctx)
 
-	queryTimeout := md.queryTimeout
-	if queryTimeout > 0 {
-		ctx, _ = context.WithTimeout(ctx, queryTimeout)
+	if revision < 1 {
+		return fmt.Errorf("%w: revision %d of %s/%s", ErrRevisionNotFound, revision, namespace, queryName)
 	}
-	log.Debug("query timeout defined", "timeout", queryTimeout)
-
-	revisionIndex := revision - 1
-	collection := md.client.Database(md.databaseName).Collection("query")
 
-	updates := bson.D{
-		{"$set", bson.M{fmt.Sprintf("revisions.%d.archived", revisionIndex): archived}},
+	var matched bool
+	var err error
+	if md.separateRevisions() {
+		matched, err = md.updateSeparateRevisionArchiving(ctx, namespace, queryName, revision, archived)
+	} else {
+		revisionIndex := revision - 1
+		revisionPath := fmt.Sprintf("revisions.%d", revisionIndex)
+
+		// unarchiving a revision makes its query visible again, while archiving
+		// one leaves the query as it is, in a single update
+		set := bson.M{revisionPath + ".archived": archived}
+		if !archived {
+			set["archived"] = false
+		}
+		updates := bson.M{"$set": set}
+
+		// the revision must exist when the update is applied, otherwise the
+		// server would pad the revisions with nulls up to the given index
+		err = md.run(ctx, md.write("update_revision_archiving", "query"), func(ctx context.Context, collection *mongo.Collection, _ time.Duration) error {
+			result, err := collection.UpdateOne(
+				ctx,
+				bson.M{"namespace": namespace, "name": queryName, revisionPath + ".text": bson.M{"$exists": true}},
+				updates,
+				nil,
+			)
+			if err != nil {
+				return err
+			}
+			matched = result.MatchedCount > 0
+			return nil
+		})
+	}
+	md.cache.invalidateQuery(namespace, queryName)
+	if err != nil {
+		log.Error("database communication failed when updating revision archiving", err, "namespace", namespace, "name", queryName, "revision", revision)
+		return err
 	}
-	if !archived {
-		updates = append(updates, primitive.E{Key: "$set", Value: bson.M{"archived": false}})
+
+	if !matched {
+		return md.revisionNotFound(ctx, namespace, queryName, revision)
 	}
 
-	result, err := collection.UpdateOne(
-		ctx,
-		bson.M{"namespace": namespace, "name": queryName},
-		updates,
-		nil,
-	)
+	return nil
+}
+
+// revisionNotFound tells whether the query or only the revision is missing
+// after an archiving update matched nothing.
+func (md *mongoDatabase) revisionNotFound(ctx context.Context, namespace string, queryName string, revision int) error {
+	var count int64
+	err := md.run(ctx, md.read("count_query", "query", md.queryTimeout), func(ctx context.Context, collection *mongo.Collection, maxTime time.Duration) error {
+		var err error
+		opt := options.Count().SetMaxTime(maxTime).SetLimit(1)
+		count, err = collection.CountDocuments(ctx, bson.M{"namespace": namespace, "name": queryName}, opt)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
-	if result.MatchedCount == 0 {
+	if count == 0 {
 		return restql.ErrQueryNotFoundInDatabase
 	}
 
-	return nil
+	return fmt.Errorf("%w: revision %d of %s/%s", ErrRevisionNotFound, revision, namespace, queryName)
 }
 
-func parseMaxTime(timeout time.Duration) time.Duration {
-	t := float64(timeout.Nanoseconds())
-	maxTime := time.Duration(math.Ceil(t*0.8)) * time.Nanosecond
-	return maxTime
+// namespaceExists returns mongo.ErrNoDocuments when no query is saved under the namespace,
+// telling an unknown namespace apart from one without queries matching a filter.
+func namespaceExists(ctx context.Context, collection *mongo.Collection, namespace string, maxTime time.Duration) error {
+	opt := options.Count().SetMaxTime(maxTime).SetLimit(1)
+	count, err := collection.CountDocuments(ctx, bson.M{"namespace": namespace}, opt)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
 }
 
 func isDatabaseEnabled() bool {
@@ -0,0 +1,68 @@
+package restql_mongodb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const benchmarkRevisions = 500
+
+// benchmarkQueryDocuments returns a query document with many revisions as the server
+// sends it without a projection, and as it sends it with the projections FindQuery uses:
+// the requested revision sliced, and only the archiving flags to resolve the latest one.
+func benchmarkQueryDocuments(b *testing.B) (full bson.Raw, sliced bson.Raw, archivedOnly bson.Raw) {
+	text := strings.Repeat("from hero with universe = \"DC\"\n", 32)
+
+	revisions := make(bson.A, benchmarkRevisions)
+	flags := make(bson.A, benchmarkRevisions)
+	for i := range revisions {
+		revisions[i] = bson.M{"text": fmt.Sprintf("%s// revision %d", text, i+1), "archived": i%10 == 0}
+		flags[i] = bson.M{"archived": i%10 == 0}
+	}
+
+	marshal := func(doc bson.M) bson.Raw {
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return raw
+	}
+
+	full = marshal(bson.M{"name": "fetch-dc-heroes", "namespace": "hero-catalog", "size": benchmarkRevisions, "revisions": revisions})
+	sliced = marshal(bson.M{"size": benchmarkRevisions, "revisions": revisions[benchmarkRevisions-1:]})
+	archivedOnly = marshal(bson.M{"size": benchmarkRevisions, "revisions": flags})
+
+	return full, sliced, archivedOnly
+}
+
+func benchmarkDecodeQuery(b *testing.B, raw bson.Raw) {
+	b.SetBytes(int64(len(raw)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		var q query
+		err := bson.Unmarshal(raw, &q)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeQueryFullDocument(b *testing.B) {
+	full, _, _ := benchmarkQueryDocuments(b)
+	benchmarkDecodeQuery(b, full)
+}
+
+func BenchmarkDecodeQuerySlicedRevision(b *testing.B) {
+	_, sliced, _ := benchmarkQueryDocuments(b)
+	benchmarkDecodeQuery(b, sliced)
+}
+
+func BenchmarkDecodeQueryArchivedFlags(b *testing.B) {
+	_, _, archivedOnly := benchmarkQueryDocuments(b)
+	benchmarkDecodeQuery(b, archivedOnly)
+}
@@ -0,0 +1,81 @@
+package restql_mongodb
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/b2wdigital/restQL-golang/v6/pkg/restql"
+)
+
+// RevisionMetadata records when, by whom and why a revision was created.
+// Revisions created before it was recorded have it empty.
+type RevisionMetadata struct {
+	CreatedAt time.Time `bson:"createdAt,omitempty" json:"createdAt,omitempty"`
+	Author    string    `bson:"author,omitempty" json:"author,omitempty"`
+	SHA256    string    `bson:"sha256,omitempty" json:"sha256,omitempty"`
+	Message   string    `bson:"message,omitempty" json:"message,omitempty"`
+}
+
+// QueryRevision is a saved query revision with its metadata.
+type QueryRevision struct {
+	restql.SavedQueryRevision
+	RevisionMetadata
+}
+
+type authorCtxKey struct{}
+type headersCtxKey struct{}
+
+// WithAuthor returns a context recording the given author on the revisions created with it.
+func WithAuthor(ctx context.Context, author string) context.Context {
+	return context.WithValue(ctx, authorCtxKey{}, author)
+}
+
+// WithHeaders returns a context carrying the headers of the request creating revisions,
+// from which the author is read when AuthorHeader is set and no author was given.
+func WithHeaders(ctx context.Context, headers http.Header) context.Context {
+	return context.WithValue(ctx, headersCtxKey{}, headers)
+}
+
+func (md *mongoDatabase) authorFromContext(ctx context.Context) string {
+	if author, ok := ctx.Value(authorCtxKey{}).(string); ok && author != "" {
+		return author
+	}
+
+	if headers, ok := ctx.Value(headersCtxKey{}).(http.Header); ok && md.config.AuthorHeader != "" {
+		return headers.Get(md.config.AuthorHeader)
+	}
+
+	return ""
+}
+
+func (md *mongoDatabase) newRevisionMetadata(ctx context.Context, content string, message string) RevisionMetadata {
+	sum := sha256.Sum256([]byte(content))
+
+	return RevisionMetadata{
+		CreatedAt: time.Now().UTC(),
+		Author:    md.authorFromContext(ctx),
+		SHA256:    hex.EncodeToString(sum[:]),
+		Message:   message,
+	}
+}
+
+// FindQueryRevision fetches a revision like FindQuery, with its metadata.
+func (md *mongoDatabase) FindQueryRevision(ctx context.Context, namespace string, name string, revision int) (QueryRevision, error) {
+	if md.separateRevisions() {
+		return md.findSeparateRevision(ctx, namespace, name, revision)
+	}
+
+	return md.findEmbeddedRevision(ctx, namespace, name, revision)
+}
+
+// FindQueryRevisions fetches the revisions of a query like FindQueryWithAllRevisions, with their metadata.
+func (md *mongoDatabase) FindQueryRevisions(ctx context.Context, namespace string, queryName string, archived bool) ([]QueryRevision, error) {
+	if md.separateRevisions() {
+		return md.findSeparateQueryRevisions(ctx, namespace, queryName, archived)
+	}
+
+	return md.findEmbeddedQueryRevisions(ctx, namespace, queryName, archived)
+}
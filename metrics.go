@@ -0,0 +1,74 @@
+package restql_mongodb
+
+import (
+	"sync"
+	"time"
+)
+
+// OperationStats aggregates the executions of a database operation
+// since the plugin was created.
+type OperationStats struct {
+	Kind          string
+	Calls         uint64
+	Retries       uint64
+	NotFound      uint64
+	Errors        map[string]uint64
+	TotalDuration time.Duration
+	MaxDuration   time.Duration
+}
+
+type operationMetrics struct {
+	mu    sync.Mutex
+	stats map[string]*OperationStats
+}
+
+func newOperationMetrics() *operationMetrics {
+	return &operationMetrics{stats: make(map[string]*OperationStats)}
+}
+
+func (om *operationMetrics) observe(op operation, class errorClass, elapsed time.Duration, retries int) {
+	om.mu.Lock()
+	defer om.mu.Unlock()
+
+	s, found := om.stats[op.name]
+	if !found {
+		s = &OperationStats{Kind: string(op.kind), Errors: make(map[string]uint64)}
+		om.stats[op.name] = s
+	}
+
+	s.Calls++
+	s.Retries += uint64(retries)
+	s.TotalDuration += elapsed
+	if elapsed > s.MaxDuration {
+		s.MaxDuration = elapsed
+	}
+	switch class {
+	case errorClassNone:
+	case errorClassNotFound:
+		s.NotFound++
+	default:
+		s.Errors[string(class)]++
+	}
+}
+
+func (om *operationMetrics) snapshot() map[string]OperationStats {
+	om.mu.Lock()
+	defer om.mu.Unlock()
+
+	result := make(map[string]OperationStats, len(om.stats))
+	for name, s := range om.stats {
+		stats := *s
+		stats.Errors = make(map[string]uint64, len(s.Errors))
+		for class, count := range s.Errors {
+			stats.Errors[class] = count
+		}
+		result[name] = stats
+	}
+
+	return result
+}
+
+// OperationStats returns a copy of the statistics of every database operation.
+func (md *mongoDatabase) OperationStats() map[string]OperationStats {
+	return md.metrics.snapshot()
+}
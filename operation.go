@@ -0,0 +1,226 @@
+package restql_mongodb
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/b2wdigital/restQL-golang/v6/pkg/restql"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+type operationKind string
+
+const (
+	readOperation  operationKind = "read"
+	writeOperation operationKind = "write"
+)
+
+// errorClass groups the errors of database operations
+// for logging and metrics.
+type errorClass string
+
+const (
+	errorClassNone        errorClass = "ok"
+	errorClassNotFound    errorClass = "not_found"
+	errorClassTimeout     errorClass = "timeout"
+	errorClassCanceled    errorClass = "canceled"
+	errorClassUnavailable errorClass = "unavailable"
+	errorClassCircuitOpen errorClass = "circuit_open"
+	errorClassAuth        errorClass = "authentication"
+	errorClassConflict    errorClass = "write_conflict"
+	errorClassServer      errorClass = "server"
+	errorClassUnknown     errorClass = "unknown"
+)
+
+// operation describes a single call to the database.
+type operation struct {
+	name       string
+	collection string
+	kind       operationKind
+	timeout    time.Duration
+}
+
+func (md *mongoDatabase) read(name string, collection string, timeout time.Duration) operation {
+	return operation{name: name, collection: collection, kind: readOperation, timeout: timeout}
+}
+
+func (md *mongoDatabase) write(name string, collection string) operation {
+	return operation{name: name, collection: collection, kind: writeOperation, timeout: md.writeTimeout}
+}
+
+// operationFunc performs the database call of an operation. maxTime is the
+// server side limit that reads must apply, set a little below the time left
+// until the operation deadline so the server gives up before the client does.
+type operationFunc func(ctx context.Context, collection *mongo.Collection, maxTime time.Duration) error
+
+// run executes fn bounded by the operation timeout, recording its outcome.
+// mongo.ErrNoDocuments is returned as is, while every other error is returned as
+// one of the plugin error types, or else as a communication failure.
+// fn should only do I/O: decoding belongs to the caller, so a malformed document
+// is not mistaken for a database failure.
+func (md *mongoDatabase) run(ctx context.Context, op operation, fn operationFunc) error {
+	log := restql.GetLogger(ctx)
+	start := time.Now()
+
+	attempts, err := md.execute(ctx, op, fn)
+
+	elapsed := time.Since(start)
+	class := classifyError(err)
+	md.metrics.observe(op, class, elapsed, attempts-1)
+
+	log.Debug("database operation finished", "operation", op.name, "collection", op.collection, "kind", string(op.kind),
+		"timeout", op.timeout.String(), "duration", elapsed.String(), "outcome", string(class), "retries", attempts-1)
+	if attempts > 1 {
+		log.Info("database operation retried", "operation", op.name, "collection", op.collection, "retries", attempts-1, "outcome", string(class))
+	}
+
+	switch class {
+	case errorClassNone, errorClassNotFound:
+		return err
+	case errorClassTimeout:
+		log.Warn("database operation timed out", "operation", op.name, "collection", op.collection, "timeout", op.timeout.String())
+		return &TimeoutError{Operation: op.name, Timeout: op.timeout, Err: err}
+	case errorClassUnavailable, errorClassCircuitOpen:
+		return &UnavailableError{Operation: op.name, Err: err}
+	case errorClassAuth:
+		return &AuthenticationError{Operation: op.name, Err: md.redactError(err)}
+	case errorClassConflict:
+		return &WriteConflictError{Operation: op.name, Err: err}
+	}
+
+	return fmt.Errorf("%w: %s", restql.ErrDatabaseCommunicationFailed, err)
+}
+
+// execute calls fn unless the circuit breaker is open, retrying reads that fail
+// with a retryable error while the operation deadline allows it.
+// It returns the number of attempts made.
+func (md *mongoDatabase) execute(ctx context.Context, op operation, fn operationFunc) (int, error) {
+	collection, release, err := md.collection(op.collection)
+	if err != nil {
+		return 1, err
+	}
+	defer release()
+
+	if op.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, op.timeout)
+		defer cancel()
+	}
+
+	done, allowed := md.breaker.allow()
+	if !allowed {
+		return 1, ErrCircuitOpen
+	}
+
+	attempts, err := md.attempt(ctx, op, collection, fn)
+	done(classifyError(err))
+
+	return attempts, err
+}
+
+func (md *mongoDatabase) attempt(ctx context.Context, op operation, collection *mongo.Collection, fn operationFunc) (int, error) {
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx, collection, remainingMaxTime(ctx))
+		if err == nil || op.kind != readOperation || attempt >= md.retry.maxAttempts || !isRetryable(err) {
+			return attempt, err
+		}
+
+		restql.GetLogger(ctx).Debug("retrying database operation", "operation", op.name, "attempt", attempt, "error", err.Error())
+
+		if !md.retry.wait(ctx, attempt) {
+			return attempt, err
+		}
+	}
+}
+
+func classifyError(err error) errorClass {
+	if err == nil {
+		return errorClassNone
+	}
+
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return errorClassNotFound
+	}
+
+	if errors.Is(err, ErrCircuitOpen) {
+		return errorClassCircuitOpen
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errorClassTimeout
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return errorClassCanceled
+	}
+
+	if isAuthenticationError(err) {
+		return errorClassAuth
+	}
+
+	if isWriteConflict(err) {
+		return errorClassConflict
+	}
+
+	if errors.Is(err, restql.ErrDatabaseCommunicationFailed) ||
+		errors.Is(err, mongo.ErrClientDisconnected) ||
+		errors.Is(err, topology.ErrServerSelectionTimeout) {
+		return errorClassUnavailable
+	}
+
+	// the driver does not support unwrapping connection errors
+	var connErr topology.ConnectionError
+	if errors.As(err, &connErr) {
+		if connErr.Wrapped == context.DeadlineExceeded {
+			return errorClassTimeout
+		}
+		return errorClassUnavailable
+	}
+
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) {
+		switch {
+		case cmdErr.IsMaxTimeMSExpiredError():
+			return errorClassTimeout
+		case isRetryable(cmdErr):
+			return errorClassUnavailable
+		default:
+			return errorClassServer
+		}
+	}
+
+	var writeErr mongo.WriteException
+	if errors.As(err, &writeErr) {
+		return errorClassServer
+	}
+
+	return errorClassUnknown
+}
+
+// remainingMaxTime returns the server side limit for the time left
+// until the deadline, or zero, meaning no limit, when there is none.
+func remainingMaxTime(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+
+	maxTime := parseMaxTime(time.Until(deadline))
+	if maxTime < time.Millisecond {
+		// maxTimeMS is sent in whole milliseconds and zero disables it
+		return time.Millisecond
+	}
+
+	return maxTime
+}
+
+// parseMaxTime returns the server side limit for a client timeout.
+func parseMaxTime(timeout time.Duration) time.Duration {
+	t := float64(timeout.Nanoseconds())
+	maxTime := time.Duration(math.Ceil(t*0.8)) * time.Nanosecond
+	return maxTime
+}
@@ -0,0 +1,173 @@
+package restql_mongodb
+
+import (
+	"net/url"
+	"strings"
+)
+
+const redacted = "REDACTED"
+
+// sensitiveURIOptions are the connection string options whose values
+// must never be logged. Option names are case insensitive.
+var sensitiveURIOptions = map[string]struct{}{
+	"authmechanismproperties":         {},
+	"tlscertificatekeyfilepassword":   {},
+	"sslclientcertificatekeypassword": {},
+	"password":                        {},
+}
+
+// redactConnectionString removes the user info and the
+// sensitive options from a MongoDB connection string.
+func redactConnectionString(uri string) string {
+	prefix := ""
+	rest := uri
+	if i := strings.Index(uri, "://"); i >= 0 {
+		prefix = uri[:i+3]
+		rest = uri[i+3:]
+	}
+
+	query := ""
+	if i := strings.Index(rest, "?"); i >= 0 {
+		query = rest[i+1:]
+		rest = rest[:i]
+	}
+
+	// The user info ends at the last @ before the options,
+	// since unescaped passwords may contain @ or / themselves.
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		rest = redacted + "@" + rest[i+1:]
+	}
+
+	if query == "" {
+		return prefix + rest
+	}
+
+	return prefix + rest + "?" + redactURIOptions(query)
+}
+
+func redactURIOptions(query string) string {
+	pairs := strings.FieldsFunc(query, func(r rune) bool { return r == '&' || r == ';' })
+	for i, pair := range pairs {
+		key := pair
+		if j := strings.Index(pair, "="); j >= 0 {
+			key = pair[:j]
+		}
+
+		if _, sensitive := sensitiveURIOptions[strings.ToLower(key)]; sensitive {
+			pairs[i] = key + "=" + redacted
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+// uriSecrets returns every fragment of the connection string that would
+// leak credentials if it appeared in an error message, both in its
+// original and percent-decoded forms.
+func uriSecrets(uri string) []string {
+	secrets := []string{uri}
+
+	rest := uri
+	if i := strings.Index(rest, "://"); i >= 0 {
+		rest = rest[i+3:]
+	}
+	if i := strings.Index(rest, "?"); i >= 0 {
+		for _, pair := range strings.FieldsFunc(rest[i+1:], func(r rune) bool { return r == '&' || r == ';' }) {
+			j := strings.Index(pair, "=")
+			if j < 0 {
+				continue
+			}
+			if _, sensitive := sensitiveURIOptions[strings.ToLower(pair[:j])]; sensitive {
+				secrets = append(secrets, pair[j+1:])
+			}
+		}
+		rest = rest[:i]
+	}
+
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		userInfo := rest[:i]
+		secrets = append(secrets, userInfo)
+
+		if j := strings.Index(userInfo, ":"); j >= 0 {
+			secrets = append(secrets, userInfo[j+1:])
+		}
+	}
+
+	var result []string
+	for _, s := range secrets {
+		if s == "" {
+			continue
+		}
+		result = append(result, s)
+		if unescaped, err := url.QueryUnescape(s); err == nil && unescaped != s {
+			result = append(result, unescaped)
+		}
+	}
+
+	return result
+}
+
+// redactedError hides credentials from the message of an
+// error while preserving it for errors.Is and errors.As.
+type redactedError struct {
+	err error
+	msg string
+}
+
+func (re *redactedError) Error() string { return re.msg }
+func (re *redactedError) Unwrap() error { return re.err }
+
+// redactError replaces any credential taken from the connection
+// string that the driver may have included in the error message.
+func redactError(err error, uri string) error {
+	if err == nil || uri == "" {
+		return err
+	}
+
+	msg := err.Error()
+	redactedMsg := msg
+	for _, secret := range uriSecrets(uri) {
+		replacement := redacted
+		if secret == uri {
+			replacement = redactConnectionString(uri)
+		}
+		redactedMsg = replaceToken(redactedMsg, secret, replacement)
+	}
+
+	if redactedMsg == msg {
+		return err
+	}
+
+	return &redactedError{err: err, msg: redactedMsg}
+}
+
+// replaceToken replaces the occurrences of old that are not part of a
+// larger word, so short credentials do not mangle the rest of the message.
+func replaceToken(s string, old string, replacement string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, old)
+		if i < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+
+		end := i + len(old)
+		if isWordByte(s, i-1) || isWordByte(s, end) {
+			b.WriteString(s[:end])
+		} else {
+			b.WriteString(s[:i])
+			b.WriteString(replacement)
+		}
+		s = s[end:]
+	}
+}
+
+func isWordByte(s string, i int) bool {
+	if i < 0 || i >= len(s) {
+		return false
+	}
+
+	c := s[i]
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
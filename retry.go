@@ -0,0 +1,83 @@
+package restql_mongodb
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+)
+
+// retryPolicy decides whether and when a failed read is attempted again.
+type retryPolicy struct {
+	maxAttempts int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	jitter      float64
+}
+
+func newRetryPolicy(cfg RetryConfig) retryPolicy {
+	return retryPolicy{
+		maxAttempts: cfg.MaxAttempts,
+		baseBackoff: time.Duration(cfg.BaseBackoff),
+		maxBackoff:  time.Duration(cfg.MaxBackoff),
+		jitter:      cfg.Jitter,
+	}
+}
+
+// backoff returns the delay before the next attempt, doubling
+// from the base backoff and spread by the jitter fraction,
+// never going past the max backoff.
+func (rp retryPolicy) backoff(attempt int) time.Duration {
+	delay := rp.baseBackoff << uint(attempt-1)
+	if delay > rp.maxBackoff || delay <= 0 {
+		delay = rp.maxBackoff
+	}
+
+	if rp.jitter > 0 {
+		spread := float64(delay) * rp.jitter
+		delay += time.Duration(spread * (2*rand.Float64() - 1))
+	}
+
+	switch {
+	case delay < 0:
+		return 0
+	case delay > rp.maxBackoff:
+		return rp.maxBackoff
+	}
+
+	return delay
+}
+
+// wait sleeps before the next attempt, returning false when the
+// delay would go past the deadline of the operation.
+func (rp retryPolicy) wait(ctx context.Context, attempt int) bool {
+	delay := rp.backoff(attempt)
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= delay {
+		return false
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// isRetryable reports whether the driver labels the error as
+// retryable, such as network errors and primary step downs.
+func isRetryable(err error) bool {
+	var cmdErr mongo.CommandError
+	if !errors.As(err, &cmdErr) {
+		return false
+	}
+
+	driverErr := driver.Error{Code: cmdErr.Code, Message: cmdErr.Message, Labels: cmdErr.Labels, Name: cmdErr.Name}
+	return driverErr.Retryable()
+}
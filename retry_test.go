@@ -0,0 +1,70 @@
+package restql_mongodb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  retryPolicy
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{
+			name:    "first attempt without jitter",
+			policy:  retryPolicy{baseBackoff: 50 * time.Millisecond, maxBackoff: 500 * time.Millisecond},
+			attempt: 1,
+			min:     50 * time.Millisecond,
+			max:     50 * time.Millisecond,
+		},
+		{
+			name:    "doubles on each attempt",
+			policy:  retryPolicy{baseBackoff: 50 * time.Millisecond, maxBackoff: 500 * time.Millisecond},
+			attempt: 3,
+			min:     200 * time.Millisecond,
+			max:     200 * time.Millisecond,
+		},
+		{
+			name:    "capped at the max backoff",
+			policy:  retryPolicy{baseBackoff: 50 * time.Millisecond, maxBackoff: 500 * time.Millisecond},
+			attempt: 10,
+			min:     500 * time.Millisecond,
+			max:     500 * time.Millisecond,
+		},
+		{
+			name:    "shift overflow capped at the max backoff",
+			policy:  retryPolicy{baseBackoff: 50 * time.Millisecond, maxBackoff: 500 * time.Millisecond},
+			attempt: 70,
+			min:     500 * time.Millisecond,
+			max:     500 * time.Millisecond,
+		},
+		{
+			name:    "jitter spreads below the delay",
+			policy:  retryPolicy{baseBackoff: 100 * time.Millisecond, maxBackoff: 500 * time.Millisecond, jitter: 0.2},
+			attempt: 1,
+			min:     80 * time.Millisecond,
+			max:     120 * time.Millisecond,
+		},
+		{
+			name:    "jitter never goes past the max backoff",
+			policy:  retryPolicy{baseBackoff: 50 * time.Millisecond, maxBackoff: 500 * time.Millisecond, jitter: 0.2},
+			attempt: 10,
+			min:     400 * time.Millisecond,
+			max:     500 * time.Millisecond,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 1000; i++ {
+				got := tt.policy.backoff(tt.attempt)
+				if got < tt.min || got > tt.max {
+					t.Fatalf("backoff(%d) = %s, want between %s and %s", tt.attempt, got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
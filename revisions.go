@@ -0,0 +1,500 @@
+package restql_mongodb
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/b2wdigital/restQL-golang/v6/pkg/restql"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// revisionDocument is a query revision stored in the revisions collection,
+// used instead of the embedded revisions when RevisionsCollection is set.
+// The query document then only keeps the size and the archiving flag.
+type revisionDocument struct {
+	Namespace      string
+	Name           string
+	Revision       int
+	Text           string
+	Archived       bool
+	NormalizedHash string `bson:"normalizedHash,omitempty"`
+
+	RevisionMetadata `bson:",inline"`
+}
+
+// MigrationReport summarizes a revisions migration.
+type MigrationReport struct {
+	Queries   int
+	Revisions int
+	Skipped   []string
+}
+
+func (md *mongoDatabase) separateRevisions() bool {
+	return md.config.RevisionsCollection != ""
+}
+
+func (md *mongoDatabase) revisions(collection *mongo.Collection) *mongo.Collection {
+	return collection.Database().Collection(md.config.RevisionsCollection)
+}
+
+// archivedFilter matches the archiving flag, taking revisions
+// created before archiving existed, with no flag, as not archived.
+func archivedFilter(archived bool) interface{} {
+	if archived {
+		return true
+	}
+
+	return bson.M{"$ne": true}
+}
+
+// findSeparateRevision fetches a revision from the revisions collection.
+func (md *mongoDatabase) findSeparateRevision(ctx context.Context, namespace string, name string, revision int) (QueryRevision, error) {
+	log := restql.GetLogger(ctx)
+
+	filter := bson.M{"namespace": namespace, "name": name, "revision": revision}
+	opt := options.FindOne().SetProjection(bson.M{"_id": 0, "namespace": 0, "name": 0, "normalizedHash": 0})
+	if md.isLatestRevision(revision) {
+		filter = bson.M{"namespace": namespace, "name": name, "archived": archivedFilter(false)}
+		opt.SetSort(bson.M{"revision": -1})
+	}
+
+	var raw bson.Raw
+	err := md.run(ctx, md.read("find_query", "query", md.queryTimeout), func(ctx context.Context, collection *mongo.Collection, maxTime time.Duration) error {
+		var err error
+		raw, err = md.revisions(collection).FindOne(ctx, filter, opt.SetMaxTime(maxTime)).DecodeBytes()
+		return err
+	})
+	switch {
+	case err == mongo.ErrNoDocuments:
+		log.Error("query not found in database", err, "namespace", namespace, "name", name, "revision", revision)
+		return QueryRevision{}, restql.ErrQueryNotFoundInDatabase
+	case err != nil:
+		log.Error("database communication failed when fetching query", err, "namespace", namespace, "name", name, "revision", revision)
+		return QueryRevision{}, err
+	}
+
+	var r revisionDocument
+	err = bson.Unmarshal(raw, &r)
+	if err != nil {
+		log.Error("failed to decode query revision from database", err, "namespace", namespace, "name", name, "revision", revision)
+		return QueryRevision{}, newCorruptQueryError(namespace, name, err)
+	}
+
+	return QueryRevision{
+		SavedQueryRevision: restql.SavedQueryRevision{Name: name, Text: r.Text, Revision: r.Revision, Archived: r.Archived},
+		RevisionMetadata:   r.RevisionMetadata,
+	}, nil
+}
+
+// findSeparateQueries fetches the queries of a namespace along with their
+// revisions matching the archiving flag from the revisions collection.
+func (md *mongoDatabase) findSeparateQueries(ctx context.Context, namespace string, archived bool) ([]restql.SavedQuery, error) {
+	log := restql.GetLogger(ctx)
+
+	var queryDocuments, revisionDocuments []bson.Raw
+	err := md.run(ctx, md.read("find_queries_for_namespace", "query", md.queryTimeout), func(ctx context.Context, collection *mongo.Collection, maxTime time.Duration) error {
+		opt := options.Find().
+			SetMaxTime(maxTime).
+			SetProjection(bson.M{"_id": 0, "name": 1, "archived": 1})
+		cursor, err := collection.Find(ctx, bson.M{"namespace": namespace}, opt)
+		if err != nil {
+			return err
+		}
+		err = cursor.All(ctx, &queryDocuments)
+		if err != nil {
+			return err
+		}
+		if len(queryDocuments) == 0 {
+			return mongo.ErrNoDocuments
+		}
+
+		filter := bson.M{"namespace": namespace, "archived": archivedFilter(archived)}
+		opt = options.Find().
+			SetMaxTime(maxTime).
+			SetSort(bson.D{{Key: "name", Value: 1}, {Key: "revision", Value: 1}}).
+			SetProjection(bson.M{"_id": 0, "name": 1, "revision": 1, "text": 1, "archived": 1})
+		cursor, err = md.revisions(collection).Find(ctx, filter, opt)
+		if err != nil {
+			return err
+		}
+		return cursor.All(ctx, &revisionDocuments)
+	})
+	switch {
+	case err == mongo.ErrNoDocuments:
+		log.Error("namespace not found in database", err, "namespace", namespace)
+		return nil, fmt.Errorf("%w: %s", restql.ErrNamespaceNotFound, namespace)
+	case err != nil:
+		log.Error("database communication failed when fetching query", err, "namespace", namespace)
+		return nil, err
+	}
+
+	revisionsByName := make(map[string][]restql.SavedQueryRevision)
+	for _, document := range revisionDocuments {
+		var r revisionDocument
+		err = bson.Unmarshal(document, &r)
+		if err != nil {
+			name, _ := document.Lookup("name").StringValueOK()
+			log.Error("failed to decode query revision from database", err, "namespace", namespace, "name", name)
+			return nil, newCorruptQueryError(namespace, name, err)
+		}
+
+		queryRevision := restql.SavedQueryRevision{Name: r.Name, Text: r.Text, Archived: r.Archived, Revision: r.Revision}
+		revisionsByName[r.Name] = append(revisionsByName[r.Name], queryRevision)
+	}
+
+	queriesForNamespace := make([]restql.SavedQuery, 0, len(queryDocuments))
+	for _, document := range queryDocuments {
+		var q query
+		err = bson.Unmarshal(document, &q)
+		if err != nil {
+			name, _ := document.Lookup("name").StringValueOK()
+			log.Error("failed to decode query from database", err, "namespace", namespace, "name", name)
+			return nil, newCorruptQueryError(namespace, name, err)
+		}
+
+		queryRevisions := revisionsByName[q.Name]
+		if len(queryRevisions) == 0 {
+			continue
+		}
+
+		queriesForNamespace = append(queriesForNamespace, restql.SavedQuery{
+			Namespace: namespace,
+			Name:      q.Name,
+			Archived:  q.Archived,
+			Revisions: queryRevisions,
+		})
+	}
+
+	log.Debug("namespace queries fetched from database", "queries", queriesForNamespace, "namespace", namespace)
+
+	return queriesForNamespace, nil
+}
+
+// findSeparateQuery fetches a query along with its revisions matching
+// the archiving flag from the revisions collection.
+func (md *mongoDatabase) findSeparateQueryRevisions(ctx context.Context, namespace string, queryName string, archived bool) ([]QueryRevision, error) {
+	log := restql.GetLogger(ctx)
+
+	var documents []bson.Raw
+	err := md.run(ctx, md.read("find_query_with_all_revisions", "query", md.queryTimeout), func(ctx context.Context, collection *mongo.Collection, maxTime time.Duration) error {
+		opt := options.FindOne().SetMaxTime(maxTime).SetProjection(bson.M{"_id": 1})
+		err := collection.FindOne(ctx, bson.M{"namespace": namespace, "name": queryName}, opt).Err()
+		if err != nil {
+			return err
+		}
+
+		revisionsOpt := options.Find().
+			SetMaxTime(maxTime).
+			SetSort(bson.M{"revision": 1}).
+			SetProjection(bson.M{"_id": 0, "namespace": 0, "name": 0, "normalizedHash": 0})
+		cursor, err := md.revisions(collection).Find(ctx, bson.M{"namespace": namespace, "name": queryName, "archived": archivedFilter(archived)}, revisionsOpt)
+		if err != nil {
+			return err
+		}
+		return cursor.All(ctx, &documents)
+	})
+	switch {
+	case err == mongo.ErrNoDocuments:
+		log.Error("query not found in database", err, "namespace", namespace, "name", queryName)
+		return nil, restql.ErrQueryNotFoundInDatabase
+	case err != nil:
+		log.Error("database communication failed when fetching query", err, "namespace", namespace, "name", queryName)
+		return nil, err
+	}
+
+	queryRevisions := []QueryRevision{}
+	for _, document := range documents {
+		var r revisionDocument
+		err = bson.Unmarshal(document, &r)
+		if err != nil {
+			log.Error("failed to decode query revision from database", err, "namespace", namespace, "name", queryName)
+			return nil, newCorruptQueryError(namespace, queryName, err)
+		}
+
+		queryRevision := restql.SavedQueryRevision{
+			Name:     queryName,
+			Text:     r.Text,
+			Archived: r.Archived,
+			Revision: r.Revision,
+		}
+		queryRevisions = append(queryRevisions, QueryRevision{SavedQueryRevision: queryRevision, RevisionMetadata: r.RevisionMetadata})
+	}
+
+	log.Debug("query revisions fetched from database", "revisions", queryRevisions, "namespace", namespace, "name", queryName)
+
+	return queryRevisions, nil
+}
+
+// updateSeparateQueryArchiving sets the archiving flag of the query and every one of
+// its revisions. Being in different collections, they are not updated atomically,
+// but running it again after a failure reaches the same state.
+func (md *mongoDatabase) updateSeparateQueryArchiving(ctx context.Context, namespace string, queryName string, archived bool) (bool, error) {
+	var matched bool
+	err := md.run(ctx, md.write("update_query_archiving", "query"), func(ctx context.Context, collection *mongo.Collection, _ time.Duration) error {
+		filter := bson.M{"namespace": namespace, "name": queryName}
+		result, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"archived": archived}})
+		if err != nil {
+			return err
+		}
+		matched = result.MatchedCount > 0
+
+		if !matched {
+			return nil
+		}
+		_, err = md.revisions(collection).UpdateMany(ctx, filter, bson.M{"$set": bson.M{"archived": archived}})
+		return err
+	})
+
+	return matched, err
+}
+
+// updateSeparateRevisionArchiving archives a single revision and,
+// when unarchiving it, unarchives its query as well.
+func (md *mongoDatabase) updateSeparateRevisionArchiving(ctx context.Context, namespace string, queryName string, revision int, archived bool) (bool, error) {
+	var matched bool
+	err := md.run(ctx, md.write("update_revision_archiving", "query"), func(ctx context.Context, collection *mongo.Collection, _ time.Duration) error {
+		result, err := md.revisions(collection).UpdateOne(
+			ctx,
+			bson.M{"namespace": namespace, "name": queryName, "revision": revision},
+			bson.M{"$set": bson.M{"archived": archived}},
+		)
+		if err != nil {
+			return err
+		}
+		matched = result.MatchedCount > 0
+
+		if !matched || archived {
+			return nil
+		}
+		_, err = collection.UpdateOne(
+			ctx,
+			bson.M{"namespace": namespace, "name": queryName},
+			bson.M{"$set": bson.M{"archived": false}},
+		)
+		return err
+	})
+
+	return matched, err
+}
+
+// revisionCreateAttempts bounds how many times creating a revision
+// races with concurrent writers before giving up.
+const revisionCreateAttempts = 5
+
+// insertSeparateRevision stores the revision under the number following the latest
+// stored one, and only then creates the query or raises its size to it, so that a
+// failed write or a conflict leaves neither a revision number without its document
+// nor an empty query behind. Concurrent writers
+// race for the number on the unique index, the losers reading the latest revision
+// again. On a conflict with the expected size, it returns the latest revision instead.
+func (md *mongoDatabase) insertSeparateRevision(ctx context.Context, collection *mongo.Collection, namespace string, queryName string, rev revision, expected *int) (int, bool, error) {
+	for attempt := 1; ; attempt++ {
+		latest, err := md.latestStoredRevision(ctx, collection, namespace, queryName)
+		if err != nil {
+			return 0, false, err
+		}
+		if expected != nil && latest != *expected {
+			return latest, true, nil
+		}
+
+		number := latest + 1
+		r := revisionDocument{Namespace: namespace, Name: queryName, Revision: number, Text: rev.Text, NormalizedHash: rev.NormalizedHash, RevisionMetadata: rev.RevisionMetadata}
+		_, err = md.revisions(collection).InsertOne(ctx, r)
+		if isDuplicateKey(err) && attempt < revisionCreateAttempts {
+			continue
+		}
+		if err != nil {
+			return 0, false, err
+		}
+
+		// the query is only created along with its first revision and its size
+		// only catches up with the stored revisions, a failure here is fixed
+		// by the next revision created
+		return number, false, md.raiseSeparateSize(ctx, collection, namespace, queryName, number)
+	}
+}
+
+// raiseSeparateSize creates the query or raises its size to the given revision.
+func (md *mongoDatabase) raiseSeparateSize(ctx context.Context, collection *mongo.Collection, namespace string, queryName string, number int) error {
+	filter := bson.M{"namespace": namespace, "name": queryName}
+	update := bson.M{"$max": bson.M{"size": number}}
+
+	_, err := collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if isDuplicateKey(err) {
+		// created concurrently, the unique index kept it from being duplicated
+		_, err = collection.UpdateOne(ctx, filter, update)
+	}
+
+	return err
+}
+
+// latestStoredRevision returns the number of the latest revision stored for the query, zero if none.
+func (md *mongoDatabase) latestStoredRevision(ctx context.Context, collection *mongo.Collection, namespace string, queryName string) (int, error) {
+	opt := options.FindOne().
+		SetSort(bson.M{"revision": -1}).
+		SetProjection(bson.M{"_id": 0, "revision": 1})
+
+	var r revisionDocument
+	err := md.revisions(collection).FindOne(ctx, bson.M{"namespace": namespace, "name": queryName}, opt).Decode(&r)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+
+	return r.Revision, err
+}
+
+// findLastRevision returns the size of the query and its last revision.
+// A query that does not exist has size zero.
+func (md *mongoDatabase) findLastRevision(ctx context.Context, namespace string, queryName string) (int, revision, error) {
+	var q query
+	var last revision
+	err := md.run(ctx, md.read("find_last_revision", "query", md.queryTimeout), func(ctx context.Context, collection *mongo.Collection, maxTime time.Duration) error {
+		filter := bson.M{"namespace": namespace, "name": queryName}
+		if !md.separateRevisions() {
+			projection := bson.M{"size": 1, "revisions": bson.M{"$slice": -1}}
+			return collection.FindOne(ctx, filter, options.FindOne().SetMaxTime(maxTime).SetProjection(projection)).Decode(&q)
+		}
+
+		// the stored revisions are the reference, the size may lag behind them
+		opt := options.FindOne().
+			SetMaxTime(maxTime).
+			SetSort(bson.M{"revision": -1}).
+			SetProjection(bson.M{"_id": 0, "revision": 1, "archived": 1, "sha256": 1, "normalizedHash": 1})
+		var r revisionDocument
+		err := md.revisions(collection).FindOne(ctx, filter, opt).Decode(&r)
+		q.Size = r.Revision
+		last = revision{Archived: r.Archived, NormalizedHash: r.NormalizedHash, RevisionMetadata: r.RevisionMetadata}
+		return err
+	})
+	switch {
+	case err == mongo.ErrNoDocuments:
+		return 0, last, nil
+	case err != nil:
+		return 0, last, err
+	}
+
+	if !md.separateRevisions() && len(q.Revisions) == 1 {
+		last = q.Revisions[0]
+	}
+
+	return q.Size, last, nil
+}
+
+// newRevision builds a revision of the content, with the hash
+// the whitespace deduplication compares when it is enabled.
+func (md *mongoDatabase) newRevision(ctx context.Context, content string, message string) revision {
+	rev := revision{Text: content, RevisionMetadata: md.newRevisionMetadata(ctx, content, message)}
+	if md.config.RevisionDeduplication == DeduplicateWhitespace {
+		rev.NormalizedHash = normalizedHash(content)
+	}
+
+	return rev
+}
+
+// unchangedRevision reports whether creating the revision can be skipped, being the
+// same text as the latest revision of a query with the given size. An archived latest
+// revision never matches, nor does a size other than the one the caller expects.
+func (md *mongoDatabase) unchangedRevision(size int, latest revision, rev revision, expectedSize *int) bool {
+	return size > 0 && md.sameText(latest, rev) && !latest.Archived && (expectedSize == nil || *expectedSize == size)
+}
+
+// sameText reports whether the revision has the same text as the latest one, as compared
+// by the deduplication mode. Revisions stored without the hash of the mode never match.
+func (md *mongoDatabase) sameText(latest revision, rev revision) bool {
+	if md.config.RevisionDeduplication == DeduplicateWhitespace {
+		return latest.NormalizedHash != "" && latest.NormalizedHash == rev.NormalizedHash
+	}
+
+	return latest.SHA256 != "" && latest.SHA256 == rev.SHA256
+}
+
+// normalizedHash hashes the text ignoring whitespace differences.
+func normalizedHash(text string) string {
+	sum := sha256.Sum256([]byte(strings.Join(strings.Fields(text), " ")))
+	return hex.EncodeToString(sum[:])
+}
+
+// MigrateRevisions moves the revisions embedded in every query document to the
+// revisions collection. It can be run again safely: revisions already moved are
+// kept, and a query changed during the migration is skipped, to be moved on the
+// next run. Writes should be stopped while it runs.
+func (md *mongoDatabase) MigrateRevisions(ctx context.Context) (MigrationReport, error) {
+	var report MigrationReport
+
+	if !md.separateRevisions() {
+		return report, errors.New("revisions collection not configured")
+	}
+
+	err := md.ensureIndex(ctx, md.revisionsIndex())
+	if err != nil {
+		return report, err
+	}
+
+	collection, release, err := md.collection("query")
+	if err != nil {
+		return report, err
+	}
+	defer release()
+
+	cursor, err := collection.Find(ctx, bson.M{"revisions": bson.M{"$exists": true}})
+	if err != nil {
+		return report, errors.Wrap(err, "failed to list queries to migrate")
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var q query
+		err := cursor.Decode(&q)
+		if err != nil {
+			return report, errors.Wrap(err, "failed to decode query to migrate")
+		}
+		id := cursor.Current.Lookup("_id")
+
+		for i, r := range q.Revisions {
+			_, err := md.revisions(collection).UpdateOne(
+				ctx,
+				bson.M{"namespace": q.Namespace, "name": q.Name, "revision": i + 1},
+				bson.M{"$setOnInsert": r},
+				options.Update().SetUpsert(true),
+			)
+			if err != nil {
+				return report, errors.Wrapf(err, "failed to migrate revision %d of query %s/%s", i+1, q.Namespace, q.Name)
+			}
+		}
+
+		result, err := collection.UpdateOne(
+			ctx,
+			bson.M{"_id": id, "revisions": bson.M{"$size": len(q.Revisions)}},
+			bson.M{"$set": bson.M{"size": len(q.Revisions)}, "$unset": bson.M{"revisions": ""}},
+		)
+		if err != nil {
+			return report, errors.Wrapf(err, "failed to remove embedded revisions of query %s/%s", q.Namespace, q.Name)
+		}
+
+		if result.MatchedCount == 0 {
+			md.logger.Warn("query changed during revisions migration, skipped", "namespace", q.Namespace, "name", q.Name)
+			report.Skipped = append(report.Skipped, q.Namespace+"/"+q.Name)
+			continue
+		}
+
+		report.Queries++
+		report.Revisions += len(q.Revisions)
+		md.logger.Info("query revisions migrated", "namespace", q.Namespace, "name", q.Name, "revisions", len(q.Revisions))
+	}
+
+	err = cursor.Err()
+	if err != nil {
+		return report, errors.Wrap(err, "failed to list queries to migrate")
+	}
+
+	md.cache.purgeQueries()
+
+	return report, nil
+}
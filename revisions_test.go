@@ -0,0 +1,101 @@
+package restql_mongodb
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNormalizedHash(t *testing.T) {
+	const text = "from hero\n\twith id = 1"
+
+	same := []string{
+		"from hero with id = 1",
+		"  from hero\n  with id = 1\n",
+		"from\r\nhero with\tid  =  1",
+	}
+	for _, s := range same {
+		if normalizedHash(s) != normalizedHash(text) {
+			t.Errorf("normalizedHash(%q) != normalizedHash(%q), want them equal", s, text)
+		}
+	}
+
+	different := []string{
+		"from hero with id = 2",
+		"from herowith id = 1",
+		"",
+	}
+	for _, s := range different {
+		if normalizedHash(s) == normalizedHash(text) {
+			t.Errorf("normalizedHash(%q) == normalizedHash(%q), want them different", s, text)
+		}
+	}
+}
+
+func TestUnchangedRevision(t *testing.T) {
+	const text = "from hero\n\twith id = 1"
+	expected := func(size int) *int { return &size }
+
+	tests := []struct {
+		name       string
+		storedMode string
+		mode       string
+		stored     string
+		legacy     bool
+		archived   bool
+		size       int
+		expected   *int
+		text       string
+		want       bool
+	}{
+		{name: "exact same text", storedMode: DeduplicateExact, mode: DeduplicateExact, stored: text, size: 3, text: text, want: true},
+		{name: "exact whitespace difference", storedMode: DeduplicateExact, mode: DeduplicateExact, stored: text, size: 3, text: "from hero with id = 1", want: false},
+		{name: "exact different text", storedMode: DeduplicateExact, mode: DeduplicateExact, stored: text, size: 3, text: "from hero with id = 2", want: false},
+		{name: "whitespace same text", storedMode: DeduplicateWhitespace, mode: DeduplicateWhitespace, stored: text, size: 3, text: text, want: true},
+		{name: "whitespace difference", storedMode: DeduplicateWhitespace, mode: DeduplicateWhitespace, stored: text, size: 3, text: "  from hero with id = 1\n", want: true},
+		{name: "whitespace different text", storedMode: DeduplicateWhitespace, mode: DeduplicateWhitespace, stored: text, size: 3, text: "from hero with id = 2", want: false},
+		{name: "exact over a revision stored with whitespace", storedMode: DeduplicateWhitespace, mode: DeduplicateExact, stored: text, size: 3, text: text, want: true},
+		{name: "whitespace over a revision stored with exact", storedMode: DeduplicateExact, mode: DeduplicateWhitespace, stored: text, size: 3, text: text, want: false},
+		{name: "exact over a revision without hash", storedMode: DeduplicateExact, mode: DeduplicateExact, stored: text, legacy: true, size: 3, text: text, want: false},
+		{name: "whitespace over a revision without hash", storedMode: DeduplicateWhitespace, mode: DeduplicateWhitespace, stored: text, legacy: true, size: 3, text: text, want: false},
+		{name: "archived latest revision", storedMode: DeduplicateExact, mode: DeduplicateExact, stored: text, archived: true, size: 3, text: text, want: false},
+		{name: "query without revisions", storedMode: DeduplicateExact, mode: DeduplicateExact, size: 0, text: "", want: false},
+		{name: "expected size matching", storedMode: DeduplicateExact, mode: DeduplicateExact, stored: text, size: 3, expected: expected(3), text: text, want: true},
+		{name: "expected size not matching", storedMode: DeduplicateExact, mode: DeduplicateExact, stored: text, size: 3, expected: expected(2), text: text, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var latest revision
+			if tt.size > 0 {
+				stored := &mongoDatabase{config: Config{RevisionDeduplication: tt.storedMode}}
+				latest = stored.newRevision(context.Background(), tt.stored, "")
+				latest.Archived = tt.archived
+				if tt.legacy {
+					latest = revision{Text: latest.Text, Archived: latest.Archived}
+				}
+			}
+
+			md := &mongoDatabase{config: Config{RevisionDeduplication: tt.mode}}
+			rev := md.newRevision(context.Background(), tt.text, "")
+
+			got := md.unchangedRevision(tt.size, latest, rev, tt.expected)
+			if got != tt.want {
+				t.Errorf("unchangedRevision() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRevisionHashes(t *testing.T) {
+	for _, mode := range []string{"", DeduplicateExact, DeduplicateWhitespace} {
+		md := &mongoDatabase{config: Config{RevisionDeduplication: mode}}
+		rev := md.newRevision(context.Background(), "from hero", "")
+
+		if rev.SHA256 == "" {
+			t.Errorf("mode %q: revision without sha256", mode)
+		}
+		if hasNormalized := rev.NormalizedHash != ""; hasNormalized != (mode == DeduplicateWhitespace) {
+			t.Errorf("mode %q: normalized hash stored = %t, want it only with whitespace", mode, hasNormalized)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package restql_mongodb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/b2wdigital/restQL-golang/v6/pkg/restql"
+)
+
+// ErrDatabaseClosed is returned by every database call made after Close.
+var ErrDatabaseClosed = fmt.Errorf("%w: database closed", restql.ErrDatabaseCommunicationFailed)
+
+// runWorker starts a background worker that Close waits for.
+func (md *mongoDatabase) runWorker(ctx context.Context, worker func(ctx context.Context)) {
+	md.workers.Add(1)
+	go func() {
+		defer md.workers.Done()
+		worker(ctx)
+	}()
+}
+
+// Close stops the background workers, waits for the operations in flight
+// and disconnects the client. It is safe to call it several times, every
+// call returns the result of the first one.
+func (md *mongoDatabase) Close(ctx context.Context) error {
+	md.closeOnce.Do(func() {
+		md.closeErr = md.close(ctx)
+	})
+
+	return md.closeErr
+}
+
+func (md *mongoDatabase) close(ctx context.Context) error {
+	md.logger.Info("closing database plugin")
+
+	md.stopBackground()
+
+	workersDone := make(chan struct{})
+	go func() {
+		md.workers.Wait()
+		close(workersDone)
+	}()
+
+	// the client is disconnected even if the workers do not stop in time,
+	// as Close is only run once
+	var workersErr error
+	select {
+	case <-workersDone:
+	case <-ctx.Done():
+		md.logger.Warn("database background workers still running, disconnecting anyway")
+		workersErr = fmt.Errorf("failed to stop database background workers: %w", ctx.Err())
+	}
+
+	current := md.conn.close()
+	if current == nil {
+		if workersErr != nil {
+			return workersErr
+		}
+		md.logger.Info("database plugin closed")
+		return nil
+	}
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- current.drain(ctx)
+	}()
+
+	select {
+	case err := <-drained:
+		if err != nil {
+			return current.credentials.redactError(err)
+		}
+	case <-ctx.Done():
+		md.logger.Warn("database operations still in flight, disconnecting anyway")
+		err := current.client.Disconnect(context.Background())
+		if err != nil {
+			return current.credentials.redactError(err)
+		}
+		return workersErr
+	}
+
+	if workersErr != nil {
+		return workersErr
+	}
+
+	md.logger.Info("database plugin closed")
+
+	return nil
+}
+
+// handleSignals closes the plugin when the process receives SIGTERM or SIGINT.
+// It is meant for when the plugin runs standalone, outside restQL. Once closed,
+// the signal is raised again, so the process exits as it would without the
+// handler, or whoever else listens for it shuts down.
+func (md *mongoDatabase) handleSignals(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	var sig os.Signal
+	select {
+	case <-ctx.Done():
+		signal.Stop(signals)
+		return
+	case sig = <-signals:
+		md.logger.Info("shutdown signal received", "signal", sig.String())
+	}
+
+	// Close waits for the workers, this one included, so it must run apart.
+	go func() {
+		closeCtx, cancel := context.WithTimeout(context.Background(), time.Duration(md.config.ShutdownTimeout))
+		defer cancel()
+
+		err := md.Close(closeCtx)
+		if err != nil {
+			md.logger.Error("failed to close database plugin", err)
+		}
+
+		signal.Stop(signals)
+		err = raise(sig)
+		if err != nil {
+			md.logger.Error("failed to raise shutdown signal, exiting", err, "signal", sig.String())
+			os.Exit(1)
+		}
+	}()
+}
+
+// raise sends the signal to the current process.
+func raise(sig os.Signal) error {
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		return err
+	}
+
+	return process.Signal(sig)
+}
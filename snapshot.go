@@ -0,0 +1,259 @@
+package restql_mongodb
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/b2wdigital/restQL-golang/v6/pkg/restql"
+	"github.com/pkg/errors"
+)
+
+const snapshotFormatVersion = 1
+
+type snapshotFile struct {
+	Version   int                          `json:"version"`
+	UpdatedAt time.Time                    `json:"updatedAt"`
+	Tenants   map[string]map[string]string `json:"tenants"`
+	Queries   []snapshotQuery              `json:"queries"`
+}
+
+type snapshotQuery struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Revision  int    `json:"revision"`
+	Text      string `json:"text"`
+	Archived  bool   `json:"archived"`
+}
+
+// snapshotStore keeps the last-known-good mappings and query revisions
+// read from the database, so they can be served while it is unreachable.
+// A nil *snapshotStore is valid and stores nothing.
+type snapshotStore struct {
+	mu      sync.RWMutex
+	path    string
+	tenants map[string]map[string]string
+	queries map[queryKey]restql.SavedQueryRevision
+	dirty   bool
+}
+
+func newSnapshotStore(path string) *snapshotStore {
+	return &snapshotStore{
+		path:    path,
+		tenants: make(map[string]map[string]string),
+		queries: make(map[queryKey]restql.SavedQueryRevision),
+	}
+}
+
+// Load reads the snapshot file, if it exists, into memory.
+func (ss *snapshotStore) Load() error {
+	content, err := os.ReadFile(ss.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to read snapshot file")
+	}
+
+	var sf snapshotFile
+	err = json.Unmarshal(content, &sf)
+	if err != nil {
+		return errors.Wrap(err, "failed to decode snapshot file")
+	}
+
+	if sf.Version != snapshotFormatVersion {
+		return errors.Errorf("unsupported snapshot version %d, expected %d", sf.Version, snapshotFormatVersion)
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	for tenantID, mappings := range sf.Tenants {
+		ss.tenants[tenantID] = mappings
+	}
+	for _, q := range sf.Queries {
+		key := queryKey{Namespace: q.Namespace, Name: q.Name, Revision: q.Revision}
+		ss.queries[key] = restql.SavedQueryRevision{Name: q.Name, Text: q.Text, Revision: q.Revision, Archived: q.Archived}
+	}
+
+	return nil
+}
+
+func (ss *snapshotStore) Empty() bool {
+	if ss == nil {
+		return true
+	}
+
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+
+	return len(ss.tenants) == 0 && len(ss.queries) == 0
+}
+
+func (ss *snapshotStore) getMappings(tenantID string) (map[string]string, bool) {
+	if ss == nil {
+		return nil, false
+	}
+
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+
+	mappings, found := ss.tenants[tenantID]
+	return mappings, found
+}
+
+func (ss *snapshotStore) setMappings(tenantID string, mappings map[string]string) {
+	if ss == nil {
+		return
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.tenants[tenantID] = mappings
+	ss.dirty = true
+}
+
+func (ss *snapshotStore) getQuery(namespace string, name string, revision int) (restql.SavedQueryRevision, bool) {
+	if ss == nil {
+		return restql.SavedQueryRevision{}, false
+	}
+
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+
+	savedQuery, found := ss.queries[queryKey{Namespace: namespace, Name: name, Revision: revision}]
+	return savedQuery, found
+}
+
+func (ss *snapshotStore) setQuery(namespace string, name string, revision int, savedQuery restql.SavedQueryRevision) {
+	if ss == nil {
+		return
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.queries[queryKey{Namespace: namespace, Name: name, Revision: revision}] = savedQuery
+	ss.dirty = true
+}
+
+// Flush writes the snapshot to disk if it changed since the last flush.
+// The file is replaced atomically, so a crash never leaves a partial snapshot.
+func (ss *snapshotStore) Flush() error {
+	if ss == nil {
+		return nil
+	}
+
+	ss.mu.Lock()
+	if !ss.dirty {
+		ss.mu.Unlock()
+		return nil
+	}
+
+	sf := snapshotFile{
+		Version:   snapshotFormatVersion,
+		UpdatedAt: time.Now().UTC(),
+		Tenants:   make(map[string]map[string]string, len(ss.tenants)),
+		Queries:   make([]snapshotQuery, 0, len(ss.queries)),
+	}
+	for tenantID, mappings := range ss.tenants {
+		sf.Tenants[tenantID] = mappings
+	}
+	for key, q := range ss.queries {
+		sf.Queries = append(sf.Queries, snapshotQuery{
+			Namespace: key.Namespace,
+			Name:      key.Name,
+			Revision:  key.Revision,
+			Text:      q.Text,
+			Archived:  q.Archived,
+		})
+	}
+	ss.dirty = false
+	ss.mu.Unlock()
+
+	err := writeFileAtomically(ss.path, sf)
+	if err != nil {
+		ss.mu.Lock()
+		ss.dirty = true
+		ss.mu.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+// RunFlusher periodically flushes the snapshot until the context is cancelled,
+// then flushes one last time.
+func (ss *snapshotStore) RunFlusher(ctx context.Context, log restql.Logger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := ss.Flush(); err != nil {
+				log.Error("failed to write database snapshot", err, "path", ss.path)
+			}
+			return
+		case <-ticker.C:
+			if err := ss.Flush(); err != nil {
+				log.Error("failed to write database snapshot", err, "path", ss.path)
+			}
+		}
+	}
+}
+
+func (md *mongoDatabase) mappingsFromSnapshot(log restql.Logger, tenantID string, err error) ([]restql.Mapping, error) {
+	mappings, found := md.snapshot.getMappings(tenantID)
+	if !found {
+		return nil, err
+	}
+
+	log.Warn("serving mappings from snapshot in degraded mode", "tenant", tenantID)
+	return parseMappings(log, mappings), nil
+}
+
+func (md *mongoDatabase) queryFromSnapshot(log restql.Logger, namespace string, name string, revision int, err error) (restql.SavedQueryRevision, error) {
+	savedQuery, found := md.snapshot.getQuery(namespace, name, revision)
+	if !found {
+		return restql.SavedQueryRevision{}, err
+	}
+
+	log.Warn("serving query from snapshot in degraded mode", "namespace", namespace, "name", name, "revision", revision)
+	return savedQuery, nil
+}
+
+func writeFileAtomically(path string, sf snapshotFile) error {
+	content, err := json.Marshal(sf)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode snapshot")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary snapshot file")
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write temporary snapshot file")
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return errors.Wrap(err, "failed to replace snapshot file")
+	}
+
+	return nil
+}
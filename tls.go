@@ -0,0 +1,146 @@
+package restql_mongodb
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/b2wdigital/restQL-golang/v6/pkg/restql"
+	"github.com/pkg/errors"
+)
+
+// certificateExpiryWarning is how long before the client certificate
+// expires that a warning is logged on every reload.
+const certificateExpiryWarning = 7 * 24 * time.Hour
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// certificateReloader serves the client certificate on every TLS handshake,
+// loading it again from disk whenever the certificate or key file changes.
+type certificateReloader struct {
+	logger   restql.Logger
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertificateReloader(log restql.Logger, certFile string, keyFile string) (*certificateReloader, error) {
+	cr := &certificateReloader{logger: log, certFile: certFile, keyFile: keyFile}
+
+	_, err := cr.GetClientCertificate(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return cr, nil
+}
+
+func (cr *certificateReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	modTime, err := latestModTime(cr.certFile, cr.keyFile)
+	if err != nil {
+		if cr.cert != nil {
+			cr.logger.Error("failed to check client certificate files, using the loaded certificate", err)
+			return cr.cert, nil
+		}
+		return nil, err
+	}
+
+	if cr.cert != nil && !modTime.After(cr.modTime) {
+		return cr.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		if cr.cert != nil {
+			cr.logger.Error("failed to reload client certificate, using the loaded certificate", err)
+			return cr.cert, nil
+		}
+		return nil, errors.Wrap(err, "failed to load client certificate")
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse client certificate")
+	}
+	cert.Leaf = leaf
+
+	logCertificateExpiry(cr.logger, leaf)
+
+	cr.cert = &cert
+	cr.modTime = modTime
+
+	return cr.cert, nil
+}
+
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+func logCertificateExpiry(log restql.Logger, leaf *x509.Certificate) {
+	expiresIn := time.Until(leaf.NotAfter)
+	switch {
+	case expiresIn <= 0:
+		log.Warn("client certificate expired", "subject", leaf.Subject.String(), "expiresAt", leaf.NotAfter)
+	case expiresIn < certificateExpiryWarning:
+		log.Warn("client certificate about to expire", "subject", leaf.Subject.String(), "expiresAt", leaf.NotAfter)
+	default:
+		log.Info("client certificate loaded", "subject", leaf.Subject.String(), "expiresAt", leaf.NotAfter)
+	}
+}
+
+// tlsConfig builds the TLS settings of a client, cfg must have
+// its credentials, including the CA bundle, already resolved.
+func (md *mongoDatabase) tlsConfig(cfg Config) (*tls.Config, error) {
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if cfg.caPEM != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(cfg.caPEM)) {
+			return nil, errors.Errorf("no certificate found in CA file %s", cfg.TLS.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if md.certificates != nil {
+		tlsCfg.GetClientCertificate = md.certificates.GetClientCertificate
+	}
+
+	var once sync.Once
+	tlsCfg.VerifyConnection = func(state tls.ConnectionState) error {
+		once.Do(func() {
+			version, found := tlsVersionNames[state.Version]
+			if !found {
+				version = "unknown"
+			}
+			md.logger.Info("database tls connection negotiated", "version", version, "serverName", state.ServerName)
+		})
+		return nil
+	}
+
+	return tlsCfg, nil
+}
@@ -0,0 +1,238 @@
+package restql_mongodb
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCertificates is a self-signed CA and client certificates issued by it, as PEM.
+type testCertificates struct {
+	t      *testing.T
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	caPEM  []byte
+	serial int64
+}
+
+func newTestCertificates(t *testing.T) *testCertificates {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "restql test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCertificates{
+		t:      t,
+		ca:     ca,
+		caKey:  key,
+		caPEM:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		serial: 1,
+	}
+}
+
+// client issues a client certificate, returning it with its key as PEM.
+func (tc *testCertificates) client() (*x509.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+
+	tc.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(tc.serial),
+		Subject:      pkix.Name{CommonName: "restql"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, tc.ca, &key.PublicKey, tc.caKey)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestTLSConfig(t *testing.T) {
+	certs := newTestCertificates(t)
+	client, _, _ := certs.client()
+	dir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		caFile  []byte
+		wantErr bool
+	}{
+		{name: "CA file", caFile: certs.caPEM},
+		{name: "CA file without certificates", caFile: []byte("not a certificate\n"), wantErr: true},
+		{name: "without CA file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{}
+			if tt.caFile != nil {
+				cfg.TLS.CAFile = writeFile(t, dir, "ca.pem", tt.caFile)
+			}
+
+			resolved, err := cfg.resolveCredentials()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			md := &mongoDatabase{logger: noopLogger{}}
+			tlsCfg, err := md.tlsConfig(resolved)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("tlsConfig() returned no error for a CA file without certificates")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("tlsConfig() = %v", err)
+			}
+
+			if tlsCfg.MinVersion != tls.VersionTLS12 {
+				t.Errorf("MinVersion = %x, want TLS 1.2", tlsCfg.MinVersion)
+			}
+
+			if tt.caFile == nil {
+				if tlsCfg.RootCAs != nil {
+					t.Error("RootCAs set without a CA file, want the system roots")
+				}
+				return
+			}
+
+			_, err = client.Verify(x509.VerifyOptions{Roots: tlsCfg.RootCAs, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+			if err != nil {
+				t.Errorf("certificate issued by the CA not verified by RootCAs: %v", err)
+			}
+		})
+	}
+}
+
+func TestCertificateReloader(t *testing.T) {
+	certs := newTestCertificates(t)
+	dir := t.TempDir()
+
+	first, certPEM, keyPEM := certs.client()
+	certFile := writeFile(t, dir, "client.pem", certPEM)
+	keyFile := writeFile(t, dir, "client.key", keyPEM)
+
+	reloader, err := newCertificateReloader(noopLogger{}, certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertificateReloader() = %v", err)
+	}
+
+	assertSerial := func(t *testing.T, want *x509.Certificate) {
+		t.Helper()
+
+		got, err := reloader.GetClientCertificate(nil)
+		if err != nil {
+			t.Fatalf("GetClientCertificate() = %v", err)
+		}
+		if got.Leaf.SerialNumber.Cmp(want.SerialNumber) != 0 {
+			t.Errorf("GetClientCertificate() serial = %s, want %s", got.Leaf.SerialNumber, want.SerialNumber)
+		}
+	}
+
+	assertSerial(t, first)
+
+	modTime := time.Now().Add(time.Minute)
+
+	// rewritten with an older modification time, the loaded certificate is kept
+	_, certPEM, keyPEM = certs.client()
+	writeFile(t, dir, "client.pem", certPEM)
+	writeFile(t, dir, "client.key", keyPEM)
+	setModTime(t, modTime.Add(-time.Hour), certFile, keyFile)
+	assertSerial(t, first)
+
+	second, certPEM, keyPEM := certs.client()
+	writeFile(t, dir, "client.pem", certPEM)
+	writeFile(t, dir, "client.key", keyPEM)
+	setModTime(t, modTime, certFile, keyFile)
+	assertSerial(t, second)
+
+	// a failed reload keeps the loaded certificate
+	writeFile(t, dir, "client.pem", []byte("not a certificate\n"))
+	setModTime(t, modTime.Add(time.Minute), certFile)
+	assertSerial(t, second)
+
+	// as does a missing file
+	err = os.Remove(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSerial(t, second)
+}
+
+func TestNewCertificateReloaderWithoutFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := newCertificateReloader(noopLogger{}, filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key"))
+	if err == nil {
+		t.Error("newCertificateReloader() returned no error without the certificate files")
+	}
+}
+
+func writeFile(t *testing.T, dir string, name string, content []byte) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	err := os.WriteFile(path, content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func setModTime(t *testing.T, modTime time.Time, paths ...string) {
+	t.Helper()
+
+	for _, path := range paths {
+		err := os.Chtimes(path, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package restql_mongodb
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/b2wdigital/restQL-golang/v6/pkg/restql"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	watcherMinBackoff = time.Second
+	watcherMaxBackoff = time.Minute
+)
+
+// Server error codes relevant to change stream handling.
+const (
+	errCodeChangeStreamNotSupported = 40573
+	errCodeChangeStreamHistoryLost  = 286
+	errCodeChangeStreamFatal        = 280
+)
+
+var errChangeStreamInvalidated = errors.New("change stream invalidated")
+
+type changeEvent struct {
+	OperationType string `bson:"operationType"`
+	DocumentKey   struct {
+		ID interface{} `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument *struct {
+		Namespace string `bson:"namespace"`
+		Name      string `bson:"name"`
+	} `bson:"fullDocument"`
+}
+
+// cacheWatcher follows a collection change stream and
+// invalidates the cache entries affected by each change.
+type cacheWatcher struct {
+	logger      restql.Logger
+	collection  func() *mongo.Collection
+	onChange    func(event changeEvent)
+	onReset     func()
+	resumeToken bson.Raw
+}
+
+func newCacheWatcher(log restql.Logger, name string, collection func() *mongo.Collection, onChange func(changeEvent), onReset func()) *cacheWatcher {
+	return &cacheWatcher{
+		logger:     log.With("collection", name),
+		collection: collection,
+		onChange:   onChange,
+		onReset:    onReset,
+	}
+}
+
+// Run watches the collection until the context is cancelled or the
+// server reports that change streams are not supported, in which
+// case the cache relies only on TTL expiration.
+func (w *cacheWatcher) Run(ctx context.Context) {
+	backoff := watcherMinBackoff
+
+	for {
+		w.logger.Info("starting change stream watcher", "resuming", w.resumeToken != nil)
+
+		err := w.watch(ctx)
+		switch {
+		case ctx.Err() != nil:
+			w.logger.Info("change stream watcher stopped")
+			return
+		case isChangeStreamNotSupported(err):
+			w.logger.Warn("change streams not supported by the database, cache will rely on ttl expiration", "error", err.Error())
+			return
+		case isChangeStreamHistoryLost(err), errors.Is(err, errChangeStreamInvalidated):
+			w.logger.Warn("change stream cannot be resumed, restarting from current time", "error", err.Error())
+			w.resumeToken = nil
+			w.onReset()
+			backoff = watcherMinBackoff
+		case err != nil:
+			w.logger.Error("change stream watcher failed", err, "retryIn", backoff.String())
+		}
+
+		select {
+		case <-ctx.Done():
+			w.logger.Info("change stream watcher stopped")
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > watcherMaxBackoff {
+			backoff = watcherMaxBackoff
+		}
+	}
+}
+
+func (w *cacheWatcher) watch(ctx context.Context) error {
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if w.resumeToken != nil {
+		opts.SetResumeAfter(w.resumeToken)
+	}
+
+	stream, err := w.collection().Watch(ctx, mongo.Pipeline{}, opts)
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+
+	w.logger.Info("change stream watcher running")
+
+	// Changes missed while the stream was down are replayed
+	// when resuming, otherwise the cache may hold stale entries.
+	if w.resumeToken == nil {
+		w.onReset()
+	}
+
+	for stream.Next(ctx) {
+		var event changeEvent
+		err := stream.Decode(&event)
+		if err != nil {
+			w.logger.Error("failed to decode change stream event", err)
+			w.onReset()
+		} else {
+			w.logger.Debug("change stream event received", "operation", event.OperationType)
+			w.onChange(event)
+		}
+
+		w.resumeToken = stream.ResumeToken()
+
+		if event.OperationType == "invalidate" {
+			return errChangeStreamInvalidated
+		}
+	}
+
+	return stream.Err()
+}
+
+func isChangeStreamNotSupported(err error) bool {
+	var cmdErr mongo.CommandError
+	return errors.As(err, &cmdErr) && cmdErr.Code == errCodeChangeStreamNotSupported
+}
+
+func isChangeStreamHistoryLost(err error) bool {
+	var cmdErr mongo.CommandError
+	if !errors.As(err, &cmdErr) {
+		return false
+	}
+
+	return cmdErr.Code == errCodeChangeStreamHistoryLost || cmdErr.Code == errCodeChangeStreamFatal
+}
+
+// startCacheWatchers watches the collections through the current client,
+// so when the client is rebuilt the streams resume on the new one.
+func (md *mongoDatabase) startCacheWatchers(ctx context.Context) {
+	collection := func(name string) func() *mongo.Collection {
+		return func() *mongo.Collection {
+			return md.conn.get().Database(md.databaseName).Collection(name)
+		}
+	}
+
+	tenantWatcher := newCacheWatcher(md.logger, "tenant", collection("tenant"), md.handleTenantChange, md.cache.purgeMappings)
+	queryWatcher := newCacheWatcher(md.logger, "query", collection("query"), md.handleQueryChange, md.cache.purgeQueries)
+
+	md.runWorker(ctx, tenantWatcher.Run)
+	md.runWorker(ctx, queryWatcher.Run)
+
+	if md.separateRevisions() {
+		name := md.config.RevisionsCollection
+		revisionsWatcher := newCacheWatcher(md.logger, name, collection(name), md.handleQueryChange, md.cache.purgeQueries)
+		md.runWorker(ctx, revisionsWatcher.Run)
+	}
+}
+
+func (md *mongoDatabase) handleTenantChange(event changeEvent) {
+	tenantID, ok := event.DocumentKey.ID.(string)
+	if !ok {
+		md.cache.purgeMappings()
+		return
+	}
+
+	md.cache.invalidateMappings(tenantID)
+}
+
+func (md *mongoDatabase) handleQueryChange(event changeEvent) {
+	if event.FullDocument == nil {
+		md.cache.purgeQueries()
+		return
+	}
+
+	md.cache.invalidateQuery(event.FullDocument.Namespace, event.FullDocument.Name)
+}